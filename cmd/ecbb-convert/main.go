@@ -4,35 +4,144 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/cpu/ecbb/util"
 )
 
-// sendImage reads an imageFile and sends it to the ECBB API at the given server
-// to be encrypted with the given key. It returns the encrypted image bytes or
-// an error
-func sendImage(imageFile string, key string, server string) ([]byte, error) {
+// sendImage reads an imageFile and sends it to the ECBB API to be encrypted
+// with the given key and options. It returns the encrypted image bytes or an
+// error
+func sendImage(client *util.ECBClient, imageFile string, key string, options map[string]string) ([]byte, error) {
 	imageBytes, err := ioutil.ReadFile(imageFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return util.ECBPostImage(imageBytes, imageFile, key, server)
+	return client.PostImage(imageBytes, imageFile, key, options)
+}
+
+// visualizeFile reads an arbitrary inputFile and sends it to the ECBB API
+// visualizer. It returns a PNG of the file's bytes before and after
+// encryption or an error
+func visualizeFile(client *util.ECBClient, inputFile string, key string, options map[string]string) ([]byte, error) {
+	fileBytes, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.VisualizeFile(fileBytes, inputFile, key, options)
+}
+
+// contactSheet reads an imageFile and sends it to the ECBB API contact sheet
+// generator to be encrypted with each of the keys. It returns the contact
+// sheet PNG bytes or an error
+func contactSheet(client *util.ECBClient, imageFile string, keys []string, options map[string]string) ([]byte, error) {
+	imageBytes, err := ioutil.ReadFile(imageFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.ContactSheet(imageBytes, imageFile, keys, options)
+}
+
+// printDiagnostics prints the `Server-Timing` and `X-ECBB-*` headers the
+// server sent about how it made the result. The timing is split up so each
+// stage gets a line.
+func printDiagnostics(header http.Header) {
+	var names []string
+	for name := range header {
+		if strings.HasPrefix(name, "X-Ecbb-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, header.Get(name))
+	}
+	if timing := header.Get("Server-Timing"); timing != "" {
+		fmt.Printf("Server-Timing:\n")
+		for _, metric := range strings.Split(timing, ",") {
+			fmt.Printf("  %s\n", strings.TrimSpace(metric))
+		}
+	}
+}
+
+// intOption formats a non-zero integer flag as an option value. Zero values
+// become "" so they aren't sent to the server at all.
+func intOption(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
 }
 
 func main() {
 	key := flag.String("key", "", "AES-ECB encryption key")
+	keys := flag.String("keys", "", "comma separated AES-ECB encryption keys for a contact sheet (instead of -key)")
+	cellSize := flag.Int("cellSize", 0, "maximum width/height of each image on a -keys contact sheet (0 for the server default)")
 	inputFile := flag.String("input", "data/cc-garf.png", "input file to convert")
-	server := flag.String("server", "http://localhost:6969", "ecbb server address")
+	server := flag.String("server", "http://localhost:6969", "ecbb server address, or unix:/path/to.sock")
+	token := flag.String("token", os.Getenv("ECBB_TOKEN"), "ecbb server API token (defaults to $ECBB_TOKEN)")
+	caCert := flag.String("caCert", "", "PEM CA certificate to trust for an https -server instead of the system roots")
+	clientCert := flag.String("clientCert", "", "PEM client certificate for a -server that requires mutual TLS")
+	clientKey := flag.String("clientKey", "", "PEM private key for -clientCert")
 	outputFile := flag.String("output", "data/cc-garf.ecb.png", "file to save output to")
+	verbose := flag.Bool("verbose", false, "print the server's timing and diagnostic headers for the result")
+	maxWidth := flag.Int("maxWidth", 0, "downscale the image to at most this many pixels wide (0 for no limit)")
+	maxHeight := flag.Int("maxHeight", 0, "downscale the image to at most this many pixels high (0 for no limit)")
+	maxBytes := flag.Int("maxBytes", 0, "shrink the image until the output PNG is at most this many bytes (0 for no limit)")
+	resample := flag.String("resample", "", "resampling filter used when downscaling: box, bilinear or catmullrom")
+	layout := flag.String("layout", "", "how pixels are arranged before encryption: interleaved, planar, luma or chroma")
+	visualize := flag.Bool("visualize", false, "treat -input as arbitrary bytes and render them before and after encryption")
+	width := flag.Int("width", 0, "pixels per row when using -visualize (0 for the server default)")
+	bpp := flag.Int("bpp", 0, "bytes per pixel (1-4) when using -visualize (0 for the server default)")
 
 	flag.Parse()
 
-	if *key == "" {
-		util.ErrorQuit("You must specify a non-empty -key for encryption")
+	if *key == "" && *keys == "" {
+		util.ErrorQuit("You must specify a non-empty -key (or -keys) for encryption")
 	}
 
-	result, err := sendImage(*inputFile, *key, *server)
+	client := &util.ECBClient{Server: *server, Token: *token}
+	if *verbose {
+		client.OnResponse = printDiagnostics
+	}
+	if *caCert != "" || *clientCert != "" || *clientKey != "" {
+		httpClient, err := util.NewTLSHTTPClient(*caCert, *clientCert, *clientKey)
+		if err != nil {
+			util.ErrorQuit(err.Error())
+		}
+		client.HTTPClient = httpClient
+	}
+	var result []byte
+	var err error
+	if *keys != "" {
+		options := map[string]string{
+			"cellSize": intOption(*cellSize),
+			"layout":   *layout,
+		}
+		result, err = contactSheet(client, *inputFile, strings.Split(*keys, ","), options)
+	} else if *visualize {
+		options := map[string]string{
+			"width": intOption(*width),
+			"bpp":   intOption(*bpp),
+		}
+		result, err = visualizeFile(client, *inputFile, *key, options)
+	} else {
+		options := map[string]string{
+			"maxWidth":  intOption(*maxWidth),
+			"maxHeight": intOption(*maxHeight),
+			"maxBytes":  intOption(*maxBytes),
+			"resample":  *resample,
+			"layout":    *layout,
+		}
+		result, err = sendImage(client, *inputFile, *key, options)
+	}
 	if err != nil {
 		util.ErrorQuit(err.Error())
 	}
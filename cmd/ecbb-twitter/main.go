@@ -30,10 +30,13 @@ type bot struct {
 	httpClient    *http.Client
 	client        *twitter.Client
 	username      string
-	ecbbServer    string
+	ecbb          *util.ECBClient
 	stream        *twitter.Stream
 	jobs          chan replyJob
 	sleepDuration time.Duration
+	// linkResults asks the ecbb server to store each result and links to it
+	// in the reply, since twitter recompresses the attached copy
+	linkResults bool
 }
 
 // replyJob structs encapsulate an item of work for the bot to do in order to
@@ -52,7 +55,12 @@ func main() {
 	accessPubKey := flag.String("accessToken", "", "Twitter User Access Token")
 	accessSecKey := flag.String("accessSecret", "", "Twitter User Access Secret Key")
 	botName := flag.String("botUsername", "", "Twitter Username for Access Token/Bot Acct")
-	ecbbServer := flag.String("ecbbServer", "http://localhost:6969", "ecbb server address")
+	ecbbServer := flag.String("ecbbServer", "http://localhost:6969", "ecbb server address, or unix:/path/to.sock")
+	ecbbToken := flag.String("ecbbToken", os.Getenv("ECBB_TOKEN"), "ecbb server API token (defaults to $ECBB_TOKEN)")
+	ecbbCACert := flag.String("ecbbCACert", "", "PEM CA certificate to trust for an https -ecbbServer instead of the system roots")
+	ecbbClientCert := flag.String("ecbbClientCert", "", "PEM client certificate for an -ecbbServer that requires mutual TLS")
+	ecbbClientKey := flag.String("ecbbClientKey", "", "PEM private key for -ecbbClientCert")
+	linkResults := flag.Bool("linkResults", false, "Link to the full resolution result in replies (the ecbb server needs -store and -publicURL)")
 	flag.Parse()
 
 	if *consumerPubKey == "" || *consumerSecKey == "" {
@@ -74,14 +82,25 @@ func main() {
 	httpClient := config.Client(oauth1.NoContext, token)
 	client := twitter.NewClient(httpClient)
 
+	// The ecbb server gets its own client, it doesn't want our twitter creds
+	ecbb := &util.ECBClient{Server: *ecbbServer, Token: *ecbbToken}
+	if *ecbbCACert != "" || *ecbbClientCert != "" || *ecbbClientKey != "" {
+		ecbbHTTPClient, err := util.NewTLSHTTPClient(*ecbbCACert, *ecbbClientCert, *ecbbClientKey)
+		if err != nil {
+			util.ErrorQuit(err.Error())
+		}
+		ecbb.HTTPClient = ecbbHTTPClient
+	}
+
 	// Create a bot to wrap everything up into into one coherent object
 	b := bot{
 		httpClient:    httpClient,
 		client:        client,
 		username:      *botName,
-		ecbbServer:    *ecbbServer,
+		ecbb:          ecbb,
 		jobs:          make(chan replyJob, maximumBacklog),
 		sleepDuration: sleepDuration,
+		linkResults:   *linkResults,
 	}
 
 	fmt.Printf("[*] Drinking from the twitter firehose...\n")
@@ -192,9 +192,20 @@ func (b bot) processReply(job replyJob) {
 
 	// Create the ECB encrypted version of the image with the ECBB API
 	fmt.Printf("[*] - Sending image to ECBB API\n")
-	ecbImgBytes, err := util.ECBPostImage(imgBytes, "twitter-image.png", job.key, b.ecbbServer)
+	msg := "OK!"
+	var ecbImgBytes []byte
+	if b.linkResults {
+		var stored *util.StoredResult
+		ecbImgBytes, stored, err = b.ecbb.PostImageAndStore(imgBytes, "twitter-image.png", job.key, nil)
+		if err == nil {
+			fmt.Printf("[*] - Stored full resolution result at %q\n", stored.URL)
+			msg = fmt.Sprintf("OK! Full resolution: %s", stored.URL)
+		}
+	} else {
+		ecbImgBytes, err = b.ecbb.PostImage(imgBytes, "twitter-image.png", job.key, nil)
+	}
 	if err != nil {
-		fmt.Printf("[!] - failed to POST to %q : %s\n", b.ecbbServer, err.Error())
+		fmt.Printf("[!] - failed to POST to %q : %s\n", b.ecbb.Server, err.Error())
 		return
 	}
 
@@ -206,7 +217,7 @@ func (b bot) processReply(job replyJob) {
 		return
 	}
 	fmt.Printf("[*] Replying to user %q with media ID %d\n", job.from, mediaID)
-	_, err = b.replyToTweet(job.tweet, "OK!", mediaID)
+	_, err = b.replyToTweet(job.tweet, msg, mediaID)
 	if err != nil {
 		fmt.Printf("[!] - Couldn't reply to tweet: %s", err.Error())
 	}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runtimeSettings are the settings the admin API can change while the server
+// is running. Everything else is only read at startup (e.g. to size the
+// admission queue) so changing it would do nothing, or worse.
+var runtimeSettings = map[string]bool{
+	"rateLimit":        true,
+	"rateBurst":        true,
+	"maxBodyBytes":     true,
+	"maxPixels":        true,
+	"batchMaxFiles":    true,
+	"batchMaxBytes":    true,
+	"defaultKey":       true,
+	"requireKey":       true,
+	"minKeyLength":     true,
+	"maxKeyLength":     true,
+	"bannedKeys":       true,
+	"disabledFeatures": true,
+	"storeTTL":         true,
+	"publicURL":        true,
+}
+
+// secretSettings are never shown by the admin API or written to the audit
+// log
+var secretSettings = map[string]bool{
+	"defaultKey":         true,
+	"keyFingerprintSalt": true,
+}
+
+// redactedValue replaces the value of a secret setting
+const redactedValue = "<redacted>"
+
+// maxRecentAuditEntries is how many audit entries `/admin/audit` returns
+const maxRecentAuditEntries = 100
+
+// settingView is a setting as shown by `/admin/config`
+type settingView struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Runtime is true if the setting can be changed with a PATCH
+	Runtime bool `json:"runtime"`
+}
+
+// displayValue returns a setting's value as shown by the admin API and the
+// audit log, with secrets redacted
+func displayValue(s setting, c *config) string {
+	value := s.get(c)
+	if secretSettings[s.name] && value != "" {
+		return redactedValue
+	}
+	return value
+}
+
+// configView returns every setting in the config
+func configView(c *config) []settingView {
+	views := make([]settingView, 0, len(settings))
+	for _, s := range settings {
+		views = append(views, settingView{
+			Name:    s.name,
+			Value:   displayValue(s, c),
+			Runtime: runtimeSettings[s.name],
+		})
+	}
+	return views
+}
+
+// auditEntry records one setting changed through the admin API
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	APIKey    string    `json:"apiKey"`
+	RequestID string    `json:"requestID"`
+	ClientIP  string    `json:"clientIP"`
+	Setting   string    `json:"setting"`
+	Old       string    `json:"old"`
+	New       string    `json:"new"`
+}
+
+// auditLog keeps the most recent admin changes in memory and, if it has
+// a file, appends every change to it as a JSON line
+type auditLog struct {
+	file string
+	log  *slog.Logger
+
+	mu     sync.Mutex
+	recent []auditEntry
+}
+
+// newAuditLog creates an auditLog that appends to file, if it isn't empty
+func newAuditLog(file string, log *slog.Logger) *auditLog {
+	return &auditLog{file: file, log: log}
+}
+
+// record writes entries to the audit log. If they can't be appended to the
+// file nothing is recorded and an error is returned, so that the changes can
+// be refused rather than go unrecorded.
+func (a *auditLog) record(entries []auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != "" {
+		f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		a.log.Warn("admin changed a setting",
+			"api_key", e.APIKey,
+			"request_id", e.RequestID,
+			"setting", e.Setting,
+			"old", e.Old,
+			"new", e.New)
+	}
+	a.recent = append(a.recent, entries...)
+	if extra := len(a.recent) - maxRecentAuditEntries; extra > 0 {
+		a.recent = append([]auditEntry(nil), a.recent[extra:]...)
+	}
+	return nil
+}
+
+// entries returns the most recent audit entries, oldest first
+func (a *auditLog) entries() []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]auditEntry{}, a.recent...)
+}
+
+// updateConfig applies a set of setting changes (written like the config
+// file) to a copy of the current config, checks it, records the changes in the
+// audit log and then swaps it in. Either every change is made or none are.
+// Errors are apiErrors.
+func (s *server) updateConfig(r *http.Request, changes map[string]json.RawMessage) ([]auditEntry, error) {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	updated := *s.config()
+	var entries []auditEntry
+	now := time.Now()
+	for _, name := range names {
+		setting := findSetting(name)
+		if setting == nil {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+				fmt.Sprintf("unknown setting %q", name), nil)
+		}
+		if !runtimeSettings[name] {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+				fmt.Sprintf("setting %q can't be changed while the server is running", name), nil)
+		}
+		old, oldDisplay := setting.get(&updated), displayValue(*setting, &updated)
+		if err := setting.setJSON(&updated, changes[name]); err != nil {
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+				settingError{name, "", err}.Error(), err)
+		}
+		if setting.get(&updated) == old {
+			continue
+		}
+		entries = append(entries, auditEntry{
+			Time:      now,
+			APIKey:    jobOwner(r),
+			RequestID: requestID(r),
+			ClientIP:  s.clientIP(r),
+			Setting:   name,
+			Old:       oldDisplay,
+			New:       displayValue(*setting, &updated),
+		})
+	}
+	if err := updated.validate(); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidOption, err.Error(), err)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	if err := s.audit.record(entries); err != nil {
+		return nil, internalError(fmt.Errorf("writing audit log: %s", err))
+	}
+	s.cfg.Store(&updated)
+	return entries, nil
+}
+
+// adminConfigResponse is the JSON body returned by `/admin/config`
+type adminConfigResponse struct {
+	Settings []settingView `json:"settings"`
+	// Changes are the changes a PATCH made, if any
+	Changes []auditEntry `json:"changes,omitempty"`
+}
+
+// adminConfig is an HTTP handler that returns the effective config, or
+// changes some of its runtime settings when the method is PATCH. The PATCH
+// body is a JSON object of settings, like the config file.
+func (s *server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+
+	var resp adminConfigResponse
+	if r.Method == http.MethodPatch {
+		var changes map[string]json.RawMessage
+		if err := s.decodeJSON(w, r, &changes); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		entries, err := s.updateConfig(r, changes)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		addLogAttrs(r, slog.Int("settings_changed", len(entries)))
+		resp.Changes = entries
+	}
+	resp.Settings = configView(s.config())
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// routeRequests counts the requests handled for one route, method and status
+type routeRequests struct {
+	Route  string `json:"route"`
+	Method string `json:"method"`
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+// cacheStats describes the result cache for `/admin/stats`
+type cacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// storeStats describes the result store for `/admin/stats`
+type storeStats struct {
+	Results int   `json:"results"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// adminStatsResponse is the JSON body returned by `/admin/stats`
+type adminStatsResponse struct {
+	StartedAt     time.Time       `json:"startedAt"`
+	UptimeSeconds float64         `json:"uptimeSeconds"`
+	Draining      bool            `json:"draining"`
+	InFlight      int64           `json:"inFlight"`
+	Load          loadStatus      `json:"load"`
+	Cache         cacheStats      `json:"cache"`
+	Store         *storeStats     `json:"store,omitempty"`
+	Requests      []routeRequests `json:"requests"`
+}
+
+// adminStats is an HTTP handler that returns live stats: load, cache and
+// store usage and request counts per route, method and status
+func (s *server) adminStats(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	resp := adminStatsResponse{
+		StartedAt:     s.started,
+		UptimeSeconds: time.Since(s.started).Seconds(),
+		Draining:      s.draining.Load(),
+		InFlight:      httpInFlight.load(),
+		Load:          s.currentLoad(),
+		Cache: cacheStats{
+			Hits:      int64(cacheHits.total()),
+			Misses:    int64(cacheMisses.total()),
+			Evictions: int64(cacheEvictions.total()),
+		},
+		Requests: []routeRequests{},
+	}
+	resp.Cache.Entries, resp.Cache.Bytes = s.cache.stats()
+	if s.store != nil {
+		resp.Store = &storeStats{}
+		resp.Store.Results, resp.Store.Bytes = s.store.usage()
+	}
+	for _, v := range httpRequests.snapshot() {
+		resp.Requests = append(resp.Requests, routeRequests{
+			Route:  v.labelValues[0],
+			Method: v.labelValues[1],
+			Status: v.labelValues[2],
+			Count:  int64(v.value),
+		})
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// adminAuditResponse is the JSON body returned by `/admin/audit`
+type adminAuditResponse struct {
+	Entries []auditEntry `json:"entries"`
+}
+
+// adminAudit is an HTTP handler that returns the most recent changes made
+// through the admin API since the server started, oldest first
+func (s *server) adminAudit(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, adminAuditResponse{Entries: s.audit.entries()})
+}
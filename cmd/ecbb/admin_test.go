@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestAdminServer returns a server with the default config and an audit
+// log written to auditFile, if it isn't empty
+func newTestAdminServer(t *testing.T, auditFile string) *server {
+	t.Helper()
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("the default config is invalid: %s", err)
+	}
+	s := &server{audit: newAuditLog(auditFile, slog.New(slog.NewTextHandler(io.Discard, nil)))}
+	s.cfg.Store(&cfg)
+	return s
+}
+
+// changes builds the body of a PATCH to `/admin/config`
+func changes(t *testing.T, raw string) map[string]json.RawMessage {
+	t.Helper()
+	var c map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// wantAPIError fails the test unless err is an apiError with status
+func wantAPIError(t *testing.T, err error, status int) {
+	t.Helper()
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.status != status {
+		t.Errorf("got error %v, want a %d apiError", err, status)
+	}
+}
+
+func TestRuntimeSettingsExist(t *testing.T) {
+	for name := range runtimeSettings {
+		if findSetting(name) == nil {
+			t.Errorf("runtime setting %q isn't a setting", name)
+		}
+	}
+	for name := range secretSettings {
+		if findSetting(name) == nil {
+			t.Errorf("secret setting %q isn't a setting", name)
+		}
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	s := newTestAdminServer(t, "")
+	r := httptest.NewRequest(http.MethodPatch, "/admin/config", nil)
+	entries, err := s.updateConfig(r, changes(t, `{"rateLimit": 120, "disabledFeatures": ["wav"], "maxBodyBytes": 1024}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d audit entries, want 3", len(entries))
+	}
+	cfg := s.config()
+	if cfg.RateLimit != 120 || cfg.MaxBodyBytes != 1024 ||
+		len(cfg.DisabledFeatures) != 1 || cfg.DisabledFeatures[0] != "wav" {
+		t.Errorf("the changes weren't applied: %+v", cfg)
+	}
+	if got := len(s.audit.entries()); got != 3 {
+		t.Errorf("the audit log has %d entries, want 3", got)
+	}
+
+	// Setting a value to what it already is isn't a change
+	entries, err = s.updateConfig(r, changes(t, `{"rateLimit": 120}`))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("an unchanged setting got %d entries and error %v, want none", len(entries), err)
+	}
+}
+
+func TestUpdateConfigRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes string
+	}{
+		{"unknown setting", `{"nope": 1}`},
+		{"startup only setting", `{"listen": "0.0.0.0:80"}`},
+		{"startup only setting", `{"maxConcurrent": 64}`},
+		{"startup only secret", `{"keyFingerprintSalt": "guess"}`},
+		{"startup only file", `{"apiKeysFile": "/tmp/keys.json"}`},
+		{"bad value", `{"rateBurst": "lots"}`},
+		{"invalid value", `{"maxBodyBytes": 0}`},
+		{"invalid combination", `{"minKeyLength": 10, "maxKeyLength": 5}`},
+		{"disabling admin", `{"disabledFeatures": ["admin"]}`},
+		{"one bad change", `{"rateLimit": 120, "rateBurst": -1}`},
+	}
+	for _, tt := range tests {
+		s := newTestAdminServer(t, "")
+		before := *s.config()
+		r := httptest.NewRequest(http.MethodPatch, "/admin/config", nil)
+		_, err := s.updateConfig(r, changes(t, tt.changes))
+		wantAPIError(t, err, http.StatusBadRequest)
+		if s.config().RateLimit != before.RateLimit || s.config().MaxBodyBytes != before.MaxBodyBytes ||
+			s.config().MinKeyLength != before.MinKeyLength {
+			t.Errorf("%s: %s was partly applied", tt.name, tt.changes)
+		}
+		if got := len(s.audit.entries()); got != 0 {
+			t.Errorf("%s: %d audit entries were recorded", tt.name, got)
+		}
+	}
+}
+
+func TestUpdateConfigRedactsSecrets(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	s := newTestAdminServer(t, auditFile)
+	r := httptest.NewRequest(http.MethodPatch, "/admin/config", nil)
+	if _, err := s.updateConfig(r, changes(t, `{"defaultKey": "hunter2"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if s.config().DefaultKey != "hunter2" {
+		t.Error("defaultKey wasn't changed")
+	}
+
+	logged, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(logged), "hunter2") || !strings.Contains(string(logged), `"defaultKey"`) {
+		t.Errorf("the audit file doesn't redact defaultKey: %s", logged)
+	}
+	for _, e := range s.audit.entries() {
+		if e.Old != redactedValue || e.New != redactedValue {
+			t.Errorf("audit entry %+v isn't redacted", e)
+		}
+	}
+	for _, v := range configView(s.config()) {
+		if v.Name == "defaultKey" && v.Value != redactedValue {
+			t.Errorf("configView shows defaultKey as %q", v.Value)
+		}
+	}
+}
+
+func TestUpdateConfigNeedsTheAuditLog(t *testing.T) {
+	// A directory can't be appended to
+	s := newTestAdminServer(t, t.TempDir())
+	r := httptest.NewRequest(http.MethodPatch, "/admin/config", nil)
+	_, err := s.updateConfig(r, changes(t, `{"rateLimit": 120}`))
+	wantAPIError(t, err, http.StatusInternalServerError)
+	if s.config().RateLimit == 120 {
+		t.Error("a change that couldn't be audited was applied")
+	}
+}
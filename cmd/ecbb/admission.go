@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// admission limits how many CPU heavy requests (decode, encrypt, encode) run at
+// once. Requests over the limit wait in a bounded queue for up to a timeout.
+// Once the queue is full, or a request times out waiting, it's turned away
+// with a 503 so a burst of uploads can't make the server thrash.
+type admission struct {
+	// slots holds one value per request that's running
+	slots     chan struct{}
+	maxQueued int
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+// newAdmission creates an admission that lets maxConcurrent requests run at
+// once with up to maxQueued more waiting for up to timeout
+func newAdmission(maxConcurrent, maxQueued int, timeout time.Duration) *admission {
+	return &admission{
+		slots:     make(chan struct{}, maxConcurrent),
+		maxQueued: maxQueued,
+		timeout:   timeout,
+	}
+}
+
+// busy returns the 503 apiError for a request that couldn't be admitted. It
+// asks the client to come back after one queue timeout.
+func (a *admission) busy(message string) *apiError {
+	err := newAPIError(http.StatusServiceUnavailable, codeUnavailable, message, nil)
+	err.retryAfter = a.timeout
+	return err
+}
+
+// acquire waits for a free slot. It returns a 503 apiError if the queue is
+// full or no slot frees up within the timeout, or the context's error if it's
+// cancelled while waiting.
+func (a *admission) acquire(ctx context.Context) error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	a.mu.Lock()
+	if a.queued >= a.maxQueued {
+		a.mu.Unlock()
+		return a.busy("the server is busy, try again later")
+	}
+	a.queued++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.queued--
+		a.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return a.busy(fmt.Sprintf("the server is busy, gave up waiting after %s", a.timeout))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait waits for a free slot for as long as it takes. It's used by background
+// jobs, which have their own queue, so they don't count towards the queue
+// depth. It returns the context's error if it's cancelled while waiting.
+func (a *admission) wait(ctx context.Context) error {
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire or wait
+func (a *admission) release() {
+	<-a.slots
+}
+
+// depth returns the number of requests running and waiting
+func (a *admission) depth() (running, queued int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.slots), a.queued
+}
+
+// admit waits for a slot to run a CPU heavy request in. If the request isn't
+// admitted an error response is written and ok is false, otherwise release
+// must be called once the work is done. The time spent waiting is logged.
+func (s *server) admit(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	start := time.Now()
+	err := s.admission.acquire(r.Context())
+	addLogAttrs(r, slog.Duration("queue_wait", time.Since(start)))
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusServiceUnavailable, codeUnavailable))
+		return nil, false
+	}
+	return s.admission.release, true
+}
+
+// loadStatus is the JSON body returned by `/v1/status`
+type loadStatus struct {
+	Running       int `json:"running"`
+	MaxConcurrent int `json:"maxConcurrent"`
+	Queued        int `json:"queued"`
+	MaxQueued     int `json:"maxQueued"`
+	JobsQueued    int `json:"jobsQueued"`
+	MaxJobsQueued int `json:"maxJobsQueued"`
+}
+
+// currentLoad returns how busy the server is. The limits come from the
+// admission queue itself, which is sized when the server starts.
+func (s *server) currentLoad() loadStatus {
+	running, queued := s.admission.depth()
+	return loadStatus{
+		Running:       running,
+		MaxConcurrent: cap(s.admission.slots),
+		Queued:        queued,
+		MaxQueued:     s.admission.maxQueued,
+		JobsQueued:    len(s.jobs.queue),
+		MaxJobsQueued: cap(s.jobs.queue),
+	}
+}
+
+// status is an HTTP handler that returns how busy the server is
+func (s *server) status(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, s.currentLoad())
+}
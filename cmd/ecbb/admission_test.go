@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// formRequest returns a multipart form POST to path with the given fields
+func formRequest(t *testing.T, path string, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, path, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestBadRequestsAreNotAdmitted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxConcurrent, cfg.MaxQueued = 1, 0
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.log = testLogger
+	// Every slot is taken and nothing can queue, so a request that's
+	// admitted gets a 503
+	if err := s.admission.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.admission.release()
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		fields  map[string]string
+	}{
+		{"/new without an image", s.newECB, "/new", map[string]string{"key": "lasagna"}},
+		{"/visualize without a file", s.visualizeECB, "/visualize", map[string]string{"key": "lasagna"}},
+		{"/visualize with a bad width", s.visualizeECB, "/visualize", map[string]string{"width": "0"}},
+		{"/wav without audio", s.wavECB, "/wav", map[string]string{"key": "lasagna"}},
+		{"/wav with a bad render", s.wavECB, "/wav", map[string]string{"render": "hologram"}},
+		{"/contactsheet without an image", s.contactSheetECB, "/contactsheet", map[string]string{"keys": "a,b"}},
+		{"/contactsheet with a bad layout", s.contactSheetECB, "/contactsheet", map[string]string{"keys": "a,b", "layout": "diagonal"}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, formRequest(t, tt.path, tt.fields))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// openAPIDocument describes the `/v1` API. It's served as-is from
+// `/v1/openapi.json`.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// encryptRequest is the JSON body accepted by `/v1/encrypt`. New parameters
+// belong in `options` so the top level stays small.
+type encryptRequest struct {
+	// Image is the base64 encoded PNG or JPEG to encrypt
+	Image   string         `json:"image"`
+	Key     string         `json:"key"`
+	Options encryptOptions `json:"options"`
+	// Store saves the result for `/r/{id}` as well as returning it
+	Store bool `json:"store"`
+}
+
+// encryptParameters are the parameters that were actually used to encrypt an
+// image, after defaults were applied
+type encryptParameters struct {
+	Cipher     string         `json:"cipher"`
+	DefaultKey bool           `json:"defaultKey"`
+	Options    encryptOptions `json:"options"`
+}
+
+// encryptStats describes the input and output images of an encryption
+type encryptStats struct {
+	InputFormat  string `json:"inputFormat"`
+	InputWidth   int    `json:"inputWidth"`
+	InputHeight  int    `json:"inputHeight"`
+	OutputWidth  int    `json:"outputWidth"`
+	OutputHeight int    `json:"outputHeight"`
+	OutputBytes  int    `json:"outputBytes"`
+	blockStats
+}
+
+// encryptResponse is the JSON body returned by `/v1/encrypt`
+type encryptResponse struct {
+	// Image is the base64 encoded PNG result
+	Image       string            `json:"image"`
+	ContentType string            `json:"contentType"`
+	Parameters  encryptParameters `json:"parameters"`
+	Stats       encryptStats      `json:"stats"`
+	// Stored says where the result was saved, if the request asked for that
+	Stored    *storedResultView `json:"stored,omitempty"`
+	RequestID string            `json:"request_id"`
+}
+
+// decodeJSON limits the request body to the configured `MaxBodyBytes` and
+// decodes it as JSON into v. Unknown fields are an error so that clients find
+// out when they use a parameter this server doesn't support.
+func (s *server) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "application/json" {
+			return newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+				"request body must be application/json", err)
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.config().MaxBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON object")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("request body larger than %d bytes", s.config().MaxBodyBytes), err)
+	}
+	return newAPIError(http.StatusBadRequest, codeBadRequest,
+		"bad JSON request body: "+err.Error(), err)
+}
+
+// writeJSON writes v as a JSON response with the given status
+func (s *server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		s.writeError(w, r, internalError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// encryptV1 is an HTTP handler that ECB encrypts a base64 encoded image sent
+// as JSON and returns the result, the effective parameters and some stats as
+// JSON
+func (s *server) encryptV1(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
+		return
+	}
+
+	var req encryptRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if req.Store {
+		if err := s.checkStore(r); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	in, err := s.prepareEncrypt(r, req)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// The JSON has the request ID in it so only the image is the same each
+	// time, hence the weak ETag. A client asking for a link needs a new one
+	// even if it has the image.
+	resultKey := s.cache.key(in)
+	etag := `W/"` + resultKey + `"`
+	if !req.Store && s.notModified(w, r, etag) {
+		return
+	}
+	result, ok := s.cachedEncrypt(w, r, in, resultKey)
+	if !ok {
+		return
+	}
+	var stored *storedResultView
+	if req.Store {
+		if stored, err = s.storeResult(r, result.png); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	} else {
+		w.Header().Set("ETag", etag)
+	}
+
+	s.writeJSON(w, r, http.StatusOK, encryptResponse{
+		Image:       base64.StdEncoding.EncodeToString(result.png),
+		ContentType: "image/png",
+		Parameters:  in.parameters(),
+		Stats:       result.jsonStats(),
+		Stored:      stored,
+		RequestID:   requestID(r),
+	})
+}
+
+// encryptInput is a validated encryptRequest, ready to be encrypted
+type encryptInput struct {
+	image      []byte
+	key        string
+	defaultKey bool
+	params     encryptParams
+}
+
+// parameters returns the effective parameters of the input
+func (in encryptInput) parameters() encryptParameters {
+	return encryptParameters{
+		Cipher:     blockCipherName,
+		DefaultKey: in.defaultKey,
+		Options:    in.params.options(),
+	}
+}
+
+// prepareEncrypt applies the key policy to an encryptRequest, validates its
+// options and decodes its image. Errors are apiErrors.
+func (s *server) prepareEncrypt(r *http.Request, req encryptRequest) (encryptInput, error) {
+	var in encryptInput
+	var err error
+	in.key, in.defaultKey, err = s.resolveKey(req.Key)
+	if err != nil {
+		return in, classify(err, http.StatusBadRequest, codeInvalidOption)
+	}
+	s.logKey(r, in.key)
+
+	in.params, err = req.Options.resolve()
+	if err != nil {
+		return in, classify(err, http.StatusBadRequest, codeInvalidOption)
+	}
+	in.params.maxPixels = s.config().MaxPixels
+
+	if req.Image == "" {
+		return in, newAPIError(http.StatusBadRequest, codeMissingField, "missing \"image\"", nil)
+	}
+	in.image, err = base64.StdEncoding.DecodeString(req.Image)
+	if err != nil {
+		return in, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"image\" is not valid base64", err)
+	}
+	return in, nil
+}
+
+// jsonStats returns the stats reported for a result by the JSON API
+func (res *encryptResult) jsonStats() encryptStats {
+	return encryptStats{
+		InputFormat:  res.inputFormat,
+		InputWidth:   res.inputWidth,
+		InputHeight:  res.inputHeight,
+		OutputWidth:  res.outputWidth,
+		OutputHeight: res.outputHeight,
+		OutputBytes:  len(res.png),
+		blockStats:   res.stats,
+	}
+}
+
+// openAPI is an HTTP handler that returns the OpenAPI document for the `/v1`
+// API
+func (s *server) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
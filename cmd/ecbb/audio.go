@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"math/cmplx"
+	"net/http"
+	"time"
+)
+
+const (
+	// audioRenderWidth and audioRenderHeight are the dimensions of each
+	// waveform or spectrogram rendering
+	audioRenderWidth  = 1024
+	audioRenderHeight = 256
+	// spectrogramWindow is the number of samples in each FFT. It must be
+	// a power of two.
+	spectrogramWindow = 512
+	// spectrogramFloor is the quietest level (in dB) shown in a spectrogram
+	spectrogramFloor = -90.0
+)
+
+var (
+	waveformBackground = color.RGBA{0x10, 0x10, 0x20, 0xff}
+	waveformForeground = color.RGBA{0x5f, 0xd7, 0xff, 0xff}
+	waveformAxis       = color.RGBA{0x40, 0x40, 0x60, 0xff}
+)
+
+// renderWaveform draws the min/max envelope of samples (in the range [-1, 1])
+func renderWaveform(samples []float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, audioRenderWidth, audioRenderHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{waveformBackground}, image.Point{}, draw.Src)
+	mid := audioRenderHeight / 2
+	for x := 0; x < audioRenderWidth; x++ {
+		img.SetRGBA(x, mid, waveformAxis)
+	}
+	if len(samples) == 0 {
+		return img
+	}
+
+	// toY maps a sample value to a row, with +1 at the top
+	toY := func(v float64) int {
+		y := int(math.Round((1 - v) / 2 * float64(audioRenderHeight-1)))
+		if y < 0 {
+			return 0
+		}
+		if y > audioRenderHeight-1 {
+			return audioRenderHeight - 1
+		}
+		return y
+	}
+
+	for x := 0; x < audioRenderWidth; x++ {
+		start := x * len(samples) / audioRenderWidth
+		end := (x + 1) * len(samples) / audioRenderWidth
+		if end <= start {
+			end = start + 1
+		}
+		if end > len(samples) {
+			continue
+		}
+		lo, hi := samples[start], samples[start]
+		for _, s := range samples[start:end] {
+			lo = math.Min(lo, s)
+			hi = math.Max(hi, s)
+		}
+		for y := toY(hi); y <= toY(lo); y++ {
+			img.SetRGBA(x, y, waveformForeground)
+		}
+	}
+	return img
+}
+
+// fft performs an in-place iterative radix-2 Cooley-Tukey FFT. The length of
+// x must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	// Bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], x[start+k+size/2]*w
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// heatColor maps a value in [0, 1] to a black -> purple -> orange -> yellow
+// colour ramp
+func heatColor(v float64) color.RGBA {
+	v = math.Max(0, math.Min(1, v))
+	return color.RGBA{
+		R: uint8(255 * math.Min(1, v*1.5)),
+		G: uint8(255 * math.Max(0, v*2-1)),
+		B: uint8(255 * math.Max(0, math.Min(1, v*3)-math.Max(0, v*3-1.5))),
+		A: 0xff,
+	}
+}
+
+// renderSpectrogram draws a short-time Fourier transform of samples with time
+// on the x axis and frequency (low at the bottom) on the y axis
+func renderSpectrogram(samples []float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, audioRenderWidth, audioRenderHeight))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	if len(samples) == 0 {
+		return img
+	}
+
+	// A Hann window keeps spectral leakage from smearing everything together
+	window := make([]float64, spectrogramWindow)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(spectrogramWindow-1))
+	}
+
+	bins := spectrogramWindow / 2
+	buf := make([]complex128, spectrogramWindow)
+	for x := 0; x < audioRenderWidth; x++ {
+		// Center a window on the samples for this column
+		center := x * len(samples) / audioRenderWidth
+		start := center - spectrogramWindow/2
+		for i := range buf {
+			var s float64
+			if j := start + i; j >= 0 && j < len(samples) {
+				s = samples[j]
+			}
+			buf[i] = complex(s*window[i], 0)
+		}
+		fft(buf)
+
+		for y := 0; y < audioRenderHeight; y++ {
+			bin := (audioRenderHeight - 1 - y) * bins / audioRenderHeight
+			magnitude := cmplx.Abs(buf[bin]) / float64(bins)
+			db := 20 * math.Log10(magnitude+1e-12)
+			img.SetRGBA(x, y, heatColor((db-spectrogramFloor)/-spectrogramFloor))
+		}
+	}
+	return img
+}
+
+// wavECB is an HTTP handler that processes a multi-part form submission with
+// an 8 or 16 bit PCM `audio` WAV file and returns the WAV with its sample data
+// ECB encrypted. If the `render` form value is "waveform" or "spectrogram" it
+// instead returns a PNG comparing the original and encrypted audio.
+func (s *server) wavECB(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
+		return
+	}
+
+	if !s.parseForm(w, r) {
+		return
+	}
+
+	key, err := s.requestKey(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+	s.logKey(r, key)
+
+	var render func([]float64) *image.RGBA
+	var renderName string
+	switch mode := r.FormValue("render"); mode {
+	case "":
+	case "waveform":
+		render, renderName = renderWaveform, "renderWaveform"
+	case "spectrogram":
+		render, renderName = renderSpectrogram, "renderSpectrogram"
+	default:
+		s.writeError(w, r, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			fmt.Sprintf("\"render\" must be \"waveform\" or \"spectrogram\", got %q", mode), nil))
+		return
+	}
+
+	file, _, err := r.FormFile("audio")
+	if err != nil {
+		s.writeError(w, r, newAPIError(http.StatusBadRequest, codeMissingField,
+			"missing \"audio\" upload", err))
+		return
+	}
+	defer file.Close()
+
+	d := diagnostics{inputFormat: "wav"}
+	start := time.Now()
+	wav, err := readWAV(file)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	d.timings.observe(start, "decode", "readWAV")
+
+	addLogAttrs(r,
+		slog.Int("channels", int(wav.format.channels)),
+		slog.Int("sample_rate", int(wav.format.sampleRate)),
+		slog.Int("bits_per_sample", int(wav.format.bitsPerSample)),
+		slog.Int("data_bytes", len(wav.data())))
+
+	start = time.Now()
+	release, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	d.queueWait = time.Since(start)
+
+	start = time.Now()
+	encrypted, err := ecbEncryptWAV(wav, key)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	d.timings.observe(start, "encrypt", "ecbEncryptBytes")
+	d.stats = countBlocks([][]byte{encrypted.data()})
+
+	if render != nil {
+		start = time.Now()
+		comparison := sideBySide(render(wav.samples()), render(encrypted.samples()))
+		d.timings.observe(start, "render", renderName)
+		s.writePNG(w, r, comparison, d)
+	} else {
+		start = time.Now()
+		out := writeWAV(encrypted)
+		d.timings.observe(start, "encode", "writeWAV")
+		setDiagnosticHeaders(w, d)
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Write(out)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The features an API key can be allowed to use
+const (
+	// featureAll allows every feature except admin
+	featureAll          = "*"
+	featureEncrypt      = "encrypt"
+	featureJobs         = "jobs"
+	featureBatch        = "batch"
+	featureStore        = "store"
+	featureContactSheet = "contactsheet"
+	featureVisualize    = "visualize"
+	featureWAV          = "wav"
+	// featureAdmin allows the `/admin` API. It has to be listed explicitly.
+	featureAdmin = "admin"
+)
+
+// knownFeatures is used to check the features listed in the API keys file
+var knownFeatures = map[string]bool{
+	featureAll:          true,
+	featureEncrypt:      true,
+	featureJobs:         true,
+	featureBatch:        true,
+	featureStore:        true,
+	featureContactSheet: true,
+	featureVisualize:    true,
+	featureWAV:          true,
+	featureAdmin:        true,
+}
+
+// apiKey is one entry in the API keys file
+type apiKey struct {
+	// Name identifies the key in logs. It isn't secret.
+	Name string `json:"name"`
+	// Token is the bearer token sent by clients using the key
+	Token string `json:"token"`
+	// RateLimit and RateBurst override the server's `rateLimit` and
+	// `rateBurst` for this key. Zero means use the server's setting.
+	RateLimit int `json:"rateLimit"`
+	RateBurst int `json:"rateBurst"`
+	// Features lists what the key can be used for, "*" for everything
+	Features []string `json:"features"`
+}
+
+// allows returns true if the key can be used for the given feature
+func (k *apiKey) allows(feature string) bool {
+	for _, f := range k.Features {
+		if f == feature || (f == featureAll && feature != featureAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeysFile is the format of the API keys file
+type apiKeysFile struct {
+	Keys []*apiKey `json:"keys"`
+}
+
+// minTokenLength is the shortest bearer token accepted in the API keys file
+const minTokenLength = 16
+
+// loadAPIKeys reads and checks an API keys file. The keys are returned indexed
+// by the SHA256 hash of their token, so looking a token up doesn't leak how
+// much of it matched through timing.
+func loadAPIKeys(filename string) (map[[sha256.Size]byte]*apiKey, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file apiKeysFile
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("API keys file %q: %s", filename, err)
+	}
+
+	keys := make(map[[sha256.Size]byte]*apiKey)
+	names := make(map[string]bool)
+	for i, k := range file.Keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API keys file %q: key %d has no name", filename, i)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("API keys file %q: key name %q is used twice", filename, k.Name)
+		}
+		names[k.Name] = true
+		if len(k.Token) < minTokenLength {
+			return nil, fmt.Errorf("API keys file %q: key %q token must be at least %d characters",
+				filename, k.Name, minTokenLength)
+		}
+		if k.RateLimit < 0 || k.RateBurst < 0 {
+			return nil, fmt.Errorf("API keys file %q: key %q rate limits must not be negative",
+				filename, k.Name)
+		}
+		for _, f := range k.Features {
+			if !knownFeatures[f] {
+				return nil, fmt.Errorf("API keys file %q: key %q has unknown feature %q",
+					filename, k.Name, f)
+			}
+		}
+		hash := sha256.Sum256([]byte(k.Token))
+		if _, dupe := keys[hash]; dupe {
+			return nil, fmt.Errorf("API keys file %q: key %q reuses another key's token",
+				filename, k.Name)
+		}
+		keys[hash] = k
+	}
+	return keys, nil
+}
+
+// apiKeys holds the loaded API keys. They're replaced wholesale when the file
+// is reloaded.
+type apiKeys struct {
+	filename string
+	mu       sync.RWMutex
+	byHash   map[[sha256.Size]byte]*apiKey
+}
+
+// newAPIKeys loads the API keys from a file
+func newAPIKeys(filename string) (*apiKeys, error) {
+	keys, err := loadAPIKeys(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &apiKeys{filename: filename, byHash: keys}, nil
+}
+
+// reload reads the API keys file again. If it can't be loaded the current
+// keys are kept.
+func (a *apiKeys) reload() (int, error) {
+	keys, err := loadAPIKeys(a.filename)
+	if err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.byHash = keys
+	return len(keys), nil
+}
+
+// lookup returns the API key with the given token, or nil if there isn't one
+func (a *apiKeys) lookup(token string) *apiKey {
+	hash := sha256.Sum256([]byte(token))
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.byHash[hash]
+}
+
+// reloadAPIKeysOnSIGHUP reloads the API keys file every time the process gets
+// a SIGHUP
+func (s *server) reloadAPIKeysOnSIGHUP() {
+	if s.apiKeys == nil {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			n, err := s.apiKeys.reload()
+			if err != nil {
+				s.log.Error("reloading API keys failed, keeping the old keys", "error", err)
+				continue
+			}
+			s.log.Info("reloaded API keys", "keys", n)
+		}
+	}()
+}
+
+// authResult is what `authenticate` found out about a request
+type authResult struct {
+	// key is the API key the request was made with, if any
+	key *apiKey
+	// err is why the request's token was rejected, if it was
+	err error
+}
+
+// requestAPIKey returns the API key a request was authenticated with, or nil
+func requestAPIKey(r *http.Request) *apiKey {
+	res, _ := r.Context().Value(authKey).(*authResult)
+	if res == nil {
+		return nil
+	}
+	return res.key
+}
+
+// authenticate is middleware that checks a request's bearer token (if it has
+// one) against the API keys. It doesn't reject anything by itself, that's up
+// to `requireFeature`, so that requests with bad tokens are still rate limited
+// by IP.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	if s.apiKeys == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := &authResult{}
+		if header := r.Header.Get("Authorization"); header != "" {
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if ok {
+				res.key = s.apiKeys.lookup(strings.TrimSpace(token))
+			}
+			if res.key == nil {
+				res.err = errors.New("invalid API token")
+			} else {
+				addLogAttrs(r, slog.String("api_key", res.key.Name))
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey, res)))
+	})
+}
+
+// checkFeature returns an apiError if the feature is turned off, or if API
+// keys are configured and the request wasn't made with a key that allows the
+// feature. Requests without a valid key get a 401, keys without the feature
+// get a 403. The admin API is only available with API keys.
+func (s *server) checkFeature(r *http.Request, feature string) error {
+	for _, f := range s.config().DisabledFeatures {
+		if f == feature {
+			return newAPIError(http.StatusForbidden, codeFeatureDisabled,
+				fmt.Sprintf("%q is turned off on this server", feature), nil)
+		}
+	}
+	if s.apiKeys == nil {
+		if feature == featureAdmin {
+			return newAPIError(http.StatusForbidden, codeForbidden,
+				"the admin API needs the server to use API keys", nil)
+		}
+		return nil
+	}
+	res, _ := r.Context().Value(authKey).(*authResult)
+	switch {
+	case res == nil || (res.key == nil && res.err == nil):
+		return newAPIError(http.StatusUnauthorized, codeUnauthorized,
+			"an API token is required, send it as \"Authorization: Bearer <token>\"", nil)
+	case res.err != nil:
+		return newAPIError(http.StatusUnauthorized, codeUnauthorized,
+			res.err.Error(), nil)
+	case !res.key.allows(feature):
+		return newAPIError(http.StatusForbidden, codeForbidden,
+			fmt.Sprintf("this API key can't be used for %q", feature), nil)
+	}
+	return nil
+}
+
+// requireFeature wraps a handler so that it can only be used while the
+// feature is turned on and, when API keys are configured, with a key that
+// allows the feature
+func (s *server) requireFeature(feature string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.checkFeature(r, feature); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		next(w, r)
+	}
+}
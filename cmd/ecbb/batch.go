@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// batchManifestName is the ZIP entry read as the batch's manifest
+	batchManifestName = "manifest.json"
+	// batchReportName is the ZIP entry the batch's report is written to
+	batchReportName = "report.json"
+	// maxManifestBytes is the largest manifest accepted
+	maxManifestBytes = 1 << 20
+)
+
+// batchManifest lists the keys to encrypt a batch's files with. Files
+// without their own key use the manifest's key, then the `key` form field
+// (or query parameter), then the default key.
+//
+//	{"key": "shared", "files": {"tux.png": {"key": "just for tux"}}}
+type batchManifest struct {
+	Key   string                       `json:"key"`
+	Files map[string]batchManifestFile `json:"files"`
+}
+
+// batchManifestFile is a manifest entry for one file
+type batchManifestFile struct {
+	Key string `json:"key"`
+}
+
+// batchFile is one image in a batch
+type batchFile struct {
+	name string
+	// size is the uncompressed size the upload claims the file has
+	size uint64
+	open func() (io.ReadCloser, error)
+}
+
+// batchFileReport is the outcome for one file of a batch
+type batchFileReport struct {
+	Name       string             `json:"name"`
+	Output     string             `json:"output,omitempty"`
+	Cached     bool               `json:"cached,omitempty"`
+	Parameters *encryptParameters `json:"parameters,omitempty"`
+	Stats      *encryptStats      `json:"stats,omitempty"`
+	Error      *jobError          `json:"error,omitempty"`
+}
+
+// batchReport is the JSON report written at the end of a batch's ZIP
+type batchReport struct {
+	Files     []batchFileReport `json:"files"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	RequestID string            `json:"request_id"`
+}
+
+// batchOutputName returns the name a file's result is given in the output
+// ZIP, e.g. "cats/tux.jpg" becomes "cats/tux.ecb.png". Absolute names and
+// names that climb out of the ZIP (path traversal) are refused.
+func batchOutputName(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\:\x00") || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("file name %q is not allowed", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("file name %q is not allowed", name)
+	}
+	return strings.TrimSuffix(clean, path.Ext(clean)) + ".ecb.png", nil
+}
+
+// decodeManifest decodes a batch manifest, refusing unknown fields
+func decodeManifest(r io.Reader) (batchManifest, error) {
+	var m batchManifest
+	dec := json.NewDecoder(io.LimitReader(r, maxManifestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return m, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"the manifest is not valid JSON", err)
+	}
+	return m, nil
+}
+
+// readBatchZIP reads a batch sent as a ZIP request body. The manifest, if
+// there is one, is the `manifest.json` entry. Directories are skipped.
+func (s *server) readBatchZIP(w http.ResponseWriter, r *http.Request) ([]batchFile, batchManifest, error) {
+	var manifest batchManifest
+	r.Body = http.MaxBytesReader(w, r.Body, s.config().MaxBodyBytes)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, manifest, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+				fmt.Sprintf("request body larger than %d bytes", s.config().MaxBodyBytes), err)
+		}
+		return nil, manifest, newAPIError(http.StatusBadRequest, codeBadRequest,
+			"the request body could not be read", err)
+	}
+	// The form only has query parameters (e.g. the key and options) since
+	// the body isn't a form
+	if err := r.ParseForm(); err != nil {
+		return nil, manifest, newAPIError(http.StatusBadRequest, codeBadRequest,
+			"bad query string", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, manifest, newAPIError(http.StatusBadRequest, codeBadRequest,
+			"the request body is not a valid ZIP", err)
+	}
+
+	var files []batchFile
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if f.Name == batchManifestName {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, manifest, newAPIError(http.StatusBadRequest, codeBadRequest,
+					"the manifest could not be read", err)
+			}
+			manifest, err = decodeManifest(rc)
+			rc.Close()
+			if err != nil {
+				return nil, manifest, err
+			}
+			continue
+		}
+		files = append(files, batchFile{name: f.Name, size: f.UncompressedSize64, open: f.Open})
+	}
+	return files, manifest, nil
+}
+
+// readBatchForm reads a batch sent as a multi-part form with an `image` part
+// per file. The manifest, if there is one, is the `manifest` field.
+func readBatchForm(r *http.Request) ([]batchFile, batchManifest, error) {
+	var manifest batchManifest
+	if raw := r.FormValue("manifest"); raw != "" {
+		var err error
+		if manifest, err = decodeManifest(strings.NewReader(raw)); err != nil {
+			return nil, manifest, err
+		}
+	}
+	var files []batchFile
+	for _, fh := range r.MultipartForm.File["image"] {
+		fh := fh
+		files = append(files, batchFile{
+			name: fh.Filename,
+			size: uint64(fh.Size),
+			open: func() (io.ReadCloser, error) { return fh.Open() },
+		})
+	}
+	return files, manifest, nil
+}
+
+// checkBatch enforces `BatchMaxFiles` and `BatchMaxBytes` using the sizes the
+// upload claims, and checks that the manifest only names files in the batch
+func (s *server) checkBatch(files []batchFile, manifest batchManifest) error {
+	if len(files) == 0 {
+		return newAPIError(http.StatusBadRequest, codeMissingField, "the batch has no images", nil)
+	}
+	if len(files) > s.config().BatchMaxFiles {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("the batch has %d files, the most allowed is %d", len(files), s.config().BatchMaxFiles), nil)
+	}
+	var total uint64
+	names := make(map[string]bool)
+	for _, f := range files {
+		// Checking every file stops made up sizes overflowing the total
+		total += f.size
+		if f.size > uint64(s.config().BatchMaxBytes) || total > uint64(s.config().BatchMaxBytes) {
+			return newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+				fmt.Sprintf("the batch is larger than %d bytes uncompressed", s.config().BatchMaxBytes), nil)
+		}
+		names[f.name] = true
+	}
+	for name := range manifest.Files {
+		if !names[name] {
+			return newAPIError(http.StatusBadRequest, codeInvalidOption,
+				fmt.Sprintf("the manifest lists %q which isn't in the batch", name), nil)
+		}
+	}
+	return nil
+}
+
+// batch is an HTTP handler that encrypts every image in a ZIP, or a
+// multi-part form with many `image` parts, using the same options for every
+// image. It streams back a ZIP with a PNG per image and a `report.json`
+// describing what happened to each file. Problems with individual files are
+// reported there rather than failing the whole batch.
+func (s *server) batch(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
+		return
+	}
+
+	var files []batchFile
+	var manifest batchManifest
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/zip":
+		files, manifest, err = s.readBatchZIP(w, r)
+	case "multipart/form-data":
+		if !s.parseForm(w, r) {
+			return
+		}
+		files, manifest, err = readBatchForm(r)
+	default:
+		err = newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+			"the request body must be application/zip or multipart/form-data", nil)
+	}
+	if err == nil {
+		err = s.checkBatch(files, manifest)
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	params, err := parseEncryptParams(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+	params.maxPixels = s.config().MaxPixels
+	sharedKey := manifest.Key
+	if sharedKey == "" {
+		sharedKey = r.FormValue("key")
+	}
+
+	// The whole batch runs in one slot, one file at a time
+	start := time.Now()
+	release, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	d := diagnostics{queueWait: time.Since(start)}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="ecbb-batch.zip"`)
+	// The diagnostics add up every file, so they're only known at the end
+	w.Header().Set("Trailer", strings.Join(diagnosticTrailers, ", "))
+	w.Header().Set("X-ECBB-Cipher", blockCipherName)
+	w.Header().Set("X-ECBB-KDF", keyDerivationName)
+	zw := zip.NewWriter(w)
+	report := batchReport{RequestID: requestID(r)}
+	outputs := make(map[string]bool)
+	remaining := uint64(s.config().BatchMaxBytes)
+	for _, f := range files {
+		if r.Context().Err() != nil {
+			// The client went away, there's nobody to send the rest to
+			break
+		}
+		fr := s.encryptBatchFile(r, f, params, sharedKey, manifest, &remaining, outputs)
+		if fr.Error == nil {
+			err = s.writeBatchEntry(zw, fr.Output, fr.png)
+			if err != nil {
+				fr.Error = &jobError{Code: codeInternal, Message: internalErrorMessage}
+				s.log.Error("writing batch ZIP entry", "request_id", requestID(r), "error", err)
+			}
+		}
+		if fr.Error != nil {
+			report.Failed++
+		} else {
+			report.Succeeded++
+			d.timings.add(fr.timings)
+			d.stats.add(fr.stats)
+		}
+		report.Files = append(report.Files, fr.batchFileReport)
+	}
+
+	reportJSON, _ := json.MarshalIndent(report, "", "  ")
+	if rw, err := zw.Create(batchReportName); err == nil {
+		rw.Write(reportJSON)
+	}
+	zw.Close()
+	d.setHeaders(w.Header())
+	addLogAttrs(r,
+		slog.Int("batch_files", len(files)),
+		slog.Int("batch_failed", report.Failed))
+}
+
+// batchResult is a batchFileReport plus the PNG to write for it and how it
+// was made. timings is empty if the result was cached.
+type batchResult struct {
+	batchFileReport
+	png     []byte
+	timings stageTimings
+	stats   blockStats
+}
+
+// encryptBatchFile encrypts one file of a batch. remaining is the number of
+// uncompressed bytes the batch can still read, and outputs are the output
+// names used so far.
+func (s *server) encryptBatchFile(r *http.Request, f batchFile, params encryptParams, sharedKey string, manifest batchManifest, remaining *uint64, outputs map[string]bool) batchResult {
+	res := batchResult{batchFileReport: batchFileReport{Name: f.name}}
+	fail := func(err error) batchResult {
+		apiErr := classify(err, http.StatusBadRequest, codeInvalidOption)
+		res.Error = &jobError{Code: apiErr.code, Message: apiErr.message}
+		res.Output = ""
+		if apiErr.status >= 500 {
+			s.log.Error("batch file failed", "request_id", requestID(r), "name", f.name, "error", err)
+		}
+		return res
+	}
+
+	output, err := batchOutputName(f.name)
+	if err != nil {
+		return fail(err)
+	}
+	if outputs[output] {
+		return fail(fmt.Errorf("another file in the batch is also written to %q", output))
+	}
+	outputs[output] = true
+	res.Output = output
+
+	key := sharedKey
+	if mf, ok := manifest.Files[f.name]; ok && mf.Key != "" {
+		key = mf.Key
+	}
+	var in encryptInput
+	in.params = params
+	in.key, in.defaultKey, err = s.resolveKey(key)
+	if err != nil {
+		return fail(err)
+	}
+
+	rc, err := f.open()
+	if err != nil {
+		return fail(newAPIError(http.StatusBadRequest, codeBadRequest,
+			"the file could not be read", err))
+	}
+	// Don't trust the claimed size, a ZIP entry can unpack to far more
+	in.image, err = ioutil.ReadAll(io.LimitReader(rc, int64(*remaining)+1))
+	rc.Close()
+	if err != nil {
+		return fail(newAPIError(http.StatusBadRequest, codeBadRequest,
+			"the file could not be read", err))
+	}
+	if uint64(len(in.image)) > *remaining {
+		*remaining = 0
+		return fail(newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("the batch is larger than %d bytes uncompressed", s.config().BatchMaxBytes), nil))
+	}
+	*remaining -= uint64(len(in.image))
+
+	result, hit, err := s.cache.encrypt(r.Context(), in, nil)
+	if err != nil {
+		return fail(err)
+	}
+	parameters := in.parameters()
+	stats := result.jsonStats()
+	res.Cached = hit
+	res.Parameters = &parameters
+	res.Stats = &stats
+	res.png = result.png
+	res.stats = result.stats
+	if !hit {
+		res.timings = result.timings
+	}
+	return res
+}
+
+// writeBatchEntry adds a PNG to the output ZIP. PNGs are already compressed
+// so they're stored as-is.
+func (s *server) writeBatchEntry(zw *zip.Writer, name string, png []byte) error {
+	ew, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ew.Write(png)
+	return err
+}
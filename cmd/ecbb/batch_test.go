@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestBatchOutputName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"tux.png", "tux.ecb.png"},
+		{"tux.jpg", "tux.ecb.png"},
+		{"tux", "tux.ecb.png"},
+		{"cats/tux.jpg", "cats/tux.ecb.png"},
+		{"cats/./tux.png", "cats/tux.ecb.png"},
+		{"cats/../tux.png", "tux.ecb.png"},
+		{"a.b.png", "a.b.ecb.png"},
+	}
+	for _, tt := range tests {
+		got, err := batchOutputName(tt.name)
+		if err != nil {
+			t.Errorf("batchOutputName(%q) failed: %s", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("batchOutputName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBatchOutputNameRefused(t *testing.T) {
+	for _, name := range []string{
+		"",
+		".",
+		"..",
+		"../tux.png",
+		"cats/../../tux.png",
+		"/etc/passwd",
+		`..\tux.png`,
+		`C:\tux.png`,
+		"c:tux.png",
+		"tux\x00.png",
+	} {
+		if got, err := batchOutputName(name); err == nil {
+			t.Errorf("batchOutputName(%q) = %q, want an error", name, got)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntryOverhead is a rough guess at the bytes used by a cache entry on
+// top of its PNG, so lots of tiny results can't blow the memory budget
+const cacheEntryOverhead = 512
+
+// key returns the key an input's result is cached under: an HMAC, keyed with
+// the cache's salt, of the image's SHA256, the encryption key and every
+// option. Inputs with the same cache key always produce the same PNG, so
+// it's also used as the ETag. It's an HMAC so that someone who has the image
+// can't use the ETag to guess the key offline.
+func (c *resultCache) key(in encryptInput) string {
+	imageHash := sha256.Sum256(in.image)
+	// The options were already resolved and checked, so they always marshal
+	opts, _ := json.Marshal(in.params.options())
+	h := hmac.New(sha256.New, c.salt)
+	h.Write([]byte("ecbb result v2\x00"))
+	h.Write(imageHash[:])
+	h.Write([]byte(in.key))
+	h.Write([]byte{0})
+	h.Write(opts)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheMeta is everything about an encryptResult except its PNG. It's the
+// JSON file written next to each PNG when the cache is persisted to disk.
+type cacheMeta struct {
+	InputFormat  string     `json:"inputFormat"`
+	InputWidth   int        `json:"inputWidth"`
+	InputHeight  int        `json:"inputHeight"`
+	OutputWidth  int        `json:"outputWidth"`
+	OutputHeight int        `json:"outputHeight"`
+	Stats        blockStats `json:"stats"`
+}
+
+// cacheEntry is one cached result
+type cacheEntry struct {
+	key    string
+	result *encryptResult
+}
+
+// size returns the number of bytes an entry counts for against the budget
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.result.png)) + cacheEntryOverhead
+}
+
+// resultCache is an LRU cache of encryption results that holds up to a
+// memory budget's worth of PNGs. If it has a directory every entry is also
+// written there, so the cache survives restarts. A zero budget turns the
+// cache off.
+type resultCache struct {
+	maxBytes int64
+	dir      string
+	// salt is the HMAC key for cache keys, see key
+	salt []byte
+	log  *slog.Logger
+
+	mu   sync.Mutex
+	used int64
+	// lru has the most recently used entry at the front
+	lru   *list.List
+	byKey map[string]*list.Element
+}
+
+// newResultCache creates a resultCache with the given budget and cache key
+// salt. If dir isn't empty it's created if need be and any entries already
+// in it are loaded, most recently written first.
+func newResultCache(maxBytes int64, dir string, salt []byte, log *slog.Logger) (*resultCache, error) {
+	c := &resultCache{
+		maxBytes: maxBytes,
+		dir:      dir,
+		salt:     salt,
+		log:      log,
+		lru:      list.New(),
+		byKey:    make(map[string]*list.Element),
+	}
+	if dir == "" || maxBytes == 0 {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the entries persisted in the cache directory. Entries that
+// don't fit in the budget, and ones that can't be read, are removed.
+func (c *resultCache) load() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	// Oldest first, so the newest end up at the front of the LRU list
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, f := range files {
+		key, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		res, err := c.read(key)
+		if err != nil {
+			c.log.Warn("removing unreadable cache entry", "key", key, "error", err)
+			c.remove(key)
+			continue
+		}
+		c.add(&cacheEntry{key: key, result: res})
+	}
+	c.log.Info("loaded result cache", "dir", c.dir, "entries", c.lru.Len(), "bytes", c.used)
+	return nil
+}
+
+// read reads a persisted entry from the cache directory
+func (c *resultCache) read(key string) (*encryptResult, error) {
+	metaBytes, err := ioutil.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, err
+	}
+	png, err := ioutil.ReadFile(filepath.Join(c.dir, key+".png"))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptResult{
+		png:          png,
+		inputFormat:  meta.InputFormat,
+		inputWidth:   meta.InputWidth,
+		inputHeight:  meta.InputHeight,
+		outputWidth:  meta.OutputWidth,
+		outputHeight: meta.OutputHeight,
+		stats:        meta.Stats,
+	}, nil
+}
+
+// write persists an entry to the cache directory. Files are written under a
+// unique temporary name and renamed so a crash, or another request writing
+// the same entry, can't leave a half written entry. The PNG goes first since
+// load looks for the JSON file.
+func (c *resultCache) write(key string, res *encryptResult) error {
+	meta, err := json.Marshal(cacheMeta{
+		InputFormat:  res.inputFormat,
+		InputWidth:   res.inputWidth,
+		InputHeight:  res.inputHeight,
+		OutputWidth:  res.outputWidth,
+		OutputHeight: res.outputHeight,
+		Stats:        res.stats,
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{key + ".png", res.png}, {key + ".json", meta}} {
+		tmp, err := os.CreateTemp(c.dir, "."+f.name+".*.tmp")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(f.data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), filepath.Join(c.dir, f.name))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes a persisted entry from the cache directory
+func (c *resultCache) remove(key string) {
+	os.Remove(filepath.Join(c.dir, key+".json"))
+	os.Remove(filepath.Join(c.dir, key+".png"))
+}
+
+// add puts an entry at the front of the LRU list and evicts the least
+// recently used entries until it's back under budget. The caller must hold
+// the mutex, or be load.
+func (c *resultCache) add(e *cacheEntry) {
+	c.byKey[e.key] = c.lru.PushFront(e)
+	c.used += e.size()
+	for c.used > c.maxBytes {
+		oldest := c.lru.Back()
+		old := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.byKey, old.key)
+		c.used -= old.size()
+		cacheEvictions.add(1)
+		if c.dir != "" {
+			c.remove(old.key)
+		}
+	}
+}
+
+// get returns the cached result for a key, or nil if there isn't one
+func (c *resultCache) get(key string) *encryptResult {
+	if c.maxBytes == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.byKey[key]
+	if !ok {
+		cacheMisses.add(1)
+		return nil
+	}
+	cacheHits.add(1)
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).result
+}
+
+// put caches a result. Results bigger than the whole budget aren't cached.
+// The entry is written to the cache directory before it's added, so it can't
+// be evicted (and its files removed) before they exist.
+func (c *resultCache) put(key string, res *encryptResult) {
+	e := &cacheEntry{key: key, result: res}
+	if e.size() > c.maxBytes {
+		return
+	}
+	if c.dir != "" {
+		if err := c.write(key, res); err != nil {
+			c.log.Warn("writing result cache entry", "key", key, "error", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byKey[key]; ok {
+		// Another request encrypted the same thing at the same time
+		return
+	}
+	c.add(e)
+}
+
+// stats returns the number of entries cached and the bytes they use
+func (c *resultCache) stats() (entries int, used int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.used
+}
+
+// encrypt returns the cached result for an input, or encrypts it and caches
+// the result. It's for callers that already have an admission slot.
+func (c *resultCache) encrypt(ctx context.Context, in encryptInput, progress func(stage string)) (result *encryptResult, hit bool, err error) {
+	resultKey := c.key(in)
+	if result := c.get(resultKey); result != nil {
+		return result, true, nil
+	}
+	result, err = encryptImage(ctx, bytes.NewReader(in.image), in.key, in.params, progress)
+	if err != nil {
+		return nil, false, err
+	}
+	c.put(resultKey, result)
+	return result, false, nil
+}
+
+// etagMatches returns true if an `If-None-Match` header matches etag. Like
+// RFC 9110 says, the weak comparison is used.
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified checks a request's `If-None-Match` header against the `ETag`
+// its result would have. If it matches, a 304 is written and true is returned
+// so the client can use the copy it already has without any work being done.
+// Otherwise the caller sets the `ETag` once it has the result, so a failed
+// request doesn't send one.
+func (s *server) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag) {
+		addLogAttrs(r, slog.String("cache", "not_modified"))
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// cachedEncrypt returns the cached result for a request's input, or waits
+// for an admission slot and encrypts it, caching the result under
+// resultKey. The response's diagnostic headers are set from the result. If
+// it fails an error response is written and ok is false.
+func (s *server) cachedEncrypt(w http.ResponseWriter, r *http.Request, in encryptInput, resultKey string) (result *encryptResult, ok bool) {
+	if result := s.cache.get(resultKey); result != nil {
+		addLogAttrs(r, slog.String("cache", "hit"))
+		setDiagnosticHeaders(w, result.diagnostics(true, 0))
+		return result, true
+	}
+	addLogAttrs(r, slog.String("cache", "miss"))
+
+	start := time.Now()
+	release, ok := s.admit(w, r)
+	if !ok {
+		return nil, false
+	}
+	defer release()
+	queueWait := time.Since(start)
+
+	result, err := encryptImage(r.Context(), bytes.NewReader(in.image), in.key, in.params, nil)
+	if err != nil {
+		s.writeError(w, r, err)
+		return nil, false
+	}
+	s.cache.put(resultKey, result)
+	setDiagnosticHeaders(w, result.diagnostics(false, queueWait))
+	return result, true
+}
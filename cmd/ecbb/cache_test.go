@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogger discards everything
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testResult returns an encryptResult with a PNG of size bytes
+func testResult(size int) *encryptResult {
+	return &encryptResult{png: make([]byte, size), inputFormat: "png", inputWidth: 1, inputHeight: 1}
+}
+
+func TestCacheKey(t *testing.T) {
+	c, err := newResultCache(1<<20, "", []byte("salt"), testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := encryptOptions{}.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := encryptInput{image: []byte("image"), key: "key", params: params}
+	key := c.key(in)
+	if c.key(in) != key {
+		t.Error("the same input got a different key")
+	}
+
+	other := in
+	other.key = "other key"
+	if c.key(other) == key {
+		t.Error("a different encryption key got the same cache key")
+	}
+	other = in
+	other.image = []byte("other image")
+	if c.key(other) == key {
+		t.Error("a different image got the same cache key")
+	}
+	other = in
+	other.params, _ = encryptOptions{MaxWidth: 10}.resolve()
+	if c.key(other) == key {
+		t.Error("different options got the same cache key")
+	}
+
+	// Without the salt nobody can work out the key, or check a guessed one
+	salted, _ := newResultCache(1<<20, "", []byte("another salt"), testLogger)
+	if salted.key(in) == key {
+		t.Error("a different salt got the same cache key")
+	}
+}
+
+func TestCacheEvictsFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	// Room for two results
+	budget := int64(2 * (100 + cacheEntryOverhead))
+	c, err := newResultCache(budget, dir, []byte("salt"), testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put("a", testResult(100))
+	c.put("b", testResult(100))
+	c.get("a")
+	c.put("c", testResult(100))
+
+	if c.get("b") != nil {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+	if c.get("a") == nil || c.get("c") == nil {
+		t.Error("a recently used entry was evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.png")); !os.IsNotExist(err) {
+		t.Errorf("the evicted entry's file is still there: %v", err)
+	}
+
+	// A new cache on the same directory gets the same entries back
+	reloaded, err := newResultCache(budget, dir, []byte("salt"), testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.get("a") == nil || reloaded.get("c") == nil || reloaded.get("b") != nil {
+		t.Error("the reloaded cache has different entries")
+	}
+}
+
+func TestCacheConcurrentPutsLeaveNoOrphans(t *testing.T) {
+	dir := t.TempDir()
+	// Room for four results, so most puts evict something
+	budget := int64(4 * (100 + cacheEntryOverhead))
+	c, err := newResultCache(budget, dir, []byte("salt"), testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.put(fmt.Sprintf("%d-%d", i, j%10), testResult(100))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		key := strings.TrimSuffix(strings.TrimSuffix(f.Name(), ".json"), ".png")
+		if strings.HasPrefix(f.Name(), ".") {
+			t.Errorf("temporary file %s was left behind", f.Name())
+		} else if _, ok := c.byKey[key]; !ok {
+			t.Errorf("%s isn't in the cache", f.Name())
+		}
+	}
+}
+
+// newECBRequest returns a `/new` request uploading a 40x30 PNG
+func newECBRequest(t *testing.T) *http.Request {
+	t.Helper()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", "tux.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(img.Bytes())
+	form.WriteField("key", "lasagna")
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/new", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestETagOnlySentWithAResult(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxPixels = 40*30 - 1
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.log = testLogger
+
+	w := httptest.NewRecorder()
+	s.newECB(w, newECBRequest(t))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("the failed request sent ETag %s", etag)
+	}
+
+	cfg.MaxPixels = 40 * 30
+	s.cfg.Store(&cfg)
+	w = httptest.NewRecorder()
+	s.newECB(w, newECBRequest(t))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q, want a 200 with an ETag", w.Code, etag)
+	}
+
+	r := newECBRequest(t)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	s.newECB(w, r)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Errorf("got status %d and ETag %q, want a 304 with ETag %s", w.Code, w.Header().Get("ETag"), etag)
+	}
+}
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the ecbb server settings. Settings are loaded from (in order of
+// increasing precedence) the defaults, a JSON config file, `ECBB_*`
+// environment variables and command line flags.
+type config struct {
+	// Listen is the bind address/port for the HTTP server, or `unix:` and the
+	// path of a unix domain socket. It's ignored when systemd passes us
+	// a socket.
+	Listen string
+	// ListenSocketMode is the octal file mode a `unix:` socket is created with
+	ListenSocketMode string
+	// TLSCert and TLSKey are PEM files for the server's certificate and private
+	// key. If they're set the server speaks HTTPS.
+	TLSCert string
+	TLSKey  string
+	// TLSSelfSigned makes the server speak HTTPS with a generated self-signed
+	// certificate. It's for development only.
+	TLSSelfSigned bool
+	// TLSSelfSignedCertFile is where the generated self-signed certificate is
+	// written, so clients can be told to trust it
+	TLSSelfSignedCertFile string
+	// TLSClientCA is a PEM file of CA certificates. If it's set clients must
+	// present a certificate signed by one of them (mutual TLS).
+	TLSClientCA string
+	// ReadHeaderTimeout is how long a client has to send the request headers
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send the entire request
+	ReadTimeout time.Duration
+	// WriteTimeout is how long we have to read the request and write the
+	// response, including all of the encryption work in between
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection can sit unused
+	IdleTimeout time.Duration
+	// MaxBodyBytes is the largest request body (e.g. an image upload) accepted
+	MaxBodyBytes int64
+	// MaxPixels is the largest image (width times height) that will be
+	// decoded. Images are checked before they're decoded, so a small upload
+	// can't make the server allocate a huge bitmap.
+	MaxPixels int64
+	// MaxHeaderBytes is the largest total size of the request headers accepted
+	MaxHeaderBytes int
+	// DefaultKey is used to encrypt when the caller doesn't provide a key
+	DefaultKey string
+	// RequireKey rejects requests that don't provide a key instead of using
+	// DefaultKey
+	RequireKey bool
+	// MinKeyLength and MaxKeyLength limit the length (in characters) of caller
+	// provided keys. Zero means no limit.
+	MinKeyLength int
+	MaxKeyLength int
+	// BannedKeys are keys callers aren't allowed to use (ignoring case)
+	BannedKeys []string
+	// LogLevel is the least severe level of log message written: "debug",
+	// "info", "warn" or "error"
+	LogLevel string
+	// LogKeyFingerprints adds a salted fingerprint of each request's key to the
+	// logs. Keys themselves are never logged.
+	LogKeyFingerprints bool
+	// KeyFingerprintSalt is the salt for key fingerprints. If it's empty
+	// a random salt is used, so fingerprints only match within one run.
+	KeyFingerprintSalt string
+	// MaxConcurrent is the number of CPU heavy requests that are run at once
+	MaxConcurrent int
+	// MaxQueued is the number of CPU heavy requests that can wait for one of
+	// the MaxConcurrent slots. Requests over that get a 503.
+	MaxQueued int
+	// QueueTimeout is how long a request waits for a slot before it gets a 503
+	QueueTimeout time.Duration
+	// RateLimit is the number of requests a minute each client can make. Zero
+	// turns rate limiting off.
+	RateLimit int
+	// RateBurst is the number of requests a client can make at once
+	RateBurst int
+	// TrustedProxies are the IP addresses and CIDR prefixes of proxies whose
+	// `X-Forwarded-For` headers are believed
+	TrustedProxies []string
+	// APIKeysFile is a JSON file of API keys. If it's set every endpoint that
+	// does any work needs a bearer token from the file.
+	APIKeysFile string
+	// DisabledFeatures are API key features (e.g. "wav") turned off for
+	// everyone, whatever their key allows
+	DisabledFeatures []string
+	// AuditLogFile is a file every change made through the admin API is
+	// appended to as a JSON line
+	AuditLogFile string
+	// JobWorkers is the number of asynchronous jobs that are run at once
+	JobWorkers int
+	// JobQueueSize is the number of asynchronous jobs that can wait for a
+	// worker. Jobs submitted while the queue is full are rejected.
+	JobQueueSize int
+	// JobTTL is how long a finished job and its result are kept
+	JobTTL time.Duration
+	// JobResultBytes is the memory budget for the images of queued jobs and
+	// the results of finished ones. Jobs submitted while it's used up are
+	// rejected.
+	JobResultBytes int64
+	// JobCallbackTimeout is how long a job's completion callback has to respond
+	JobCallbackTimeout time.Duration
+	// JobCallbackAllowPrivate lets job callbacks reach loopback, private and
+	// other internal addresses. Only turn it on if every client is trusted.
+	JobCallbackAllowPrivate bool
+	// FetchSchemes are the URL schemes `/new` will fetch an `imageURL` with.
+	// If it's empty `imageURL` can't be used.
+	FetchSchemes []string
+	// FetchTimeout is how long fetching an `imageURL` can take, in total
+	FetchTimeout time.Duration
+	// FetchMaxBytes is the largest image fetched from an `imageURL`
+	FetchMaxBytes int64
+	// FetchMaxRedirects is the number of redirects followed when fetching an
+	// `imageURL`
+	FetchMaxRedirects int
+	// FetchAllowPrivate lets `imageURL` reach loopback, private and other
+	// internal addresses. Only turn it on if every client is trusted.
+	FetchAllowPrivate bool
+	// BatchMaxFiles is the most images `/v1/batch` accepts in one request
+	BatchMaxFiles int
+	// BatchMaxBytes is the largest total uncompressed size of the images in
+	// a `/v1/batch` request
+	BatchMaxBytes int64
+	// CacheBytes is the memory budget for cached results. Zero turns the
+	// cache off.
+	CacheBytes int64
+	// CacheDir is a directory cached results are also written to, so they
+	// survive restarts
+	CacheDir string
+	// Store is where results are saved when a request asks for a shareable
+	// link: "memory", "dir" or "" to turn storing off
+	Store string
+	// StoreDir is the directory results are saved in when Store is "dir"
+	StoreDir string
+	// StoreTTL is how long stored results are kept
+	StoreTTL time.Duration
+	// StoreMaxBytes is the most PNG bytes the store holds. Storing more fails
+	// until some results expire.
+	StoreMaxBytes int64
+	// PublicURL is the server's public base URL, e.g. "https://ecbb.example",
+	// used to make absolute links to stored results. If it's empty the links
+	// are relative.
+	PublicURL string
+	// ShutdownDelay is how long `/readyz` fails before the server stops
+	// accepting connections on SIGINT or SIGTERM, so load balancers can stop
+	// sending it traffic first
+	ShutdownDelay time.Duration
+	// ShutdownGracePeriod is how long in-flight requests and jobs get to
+	// finish once the server stops accepting connections
+	ShutdownGracePeriod time.Duration
+}
+
+// defaultConfig returns the settings used when nothing else is configured
+func defaultConfig() config {
+	return config{
+		Listen:              "localhost:6969",
+		ListenSocketMode:    "0660",
+		ReadHeaderTimeout:   10 * time.Second,
+		ReadTimeout:         time.Minute,
+		WriteTimeout:        2 * time.Minute,
+		IdleTimeout:         2 * time.Minute,
+		MaxBodyBytes:        32 << 20,
+		MaxPixels:           40_000_000,
+		MaxHeaderBytes:      1 << 20,
+		DefaultKey:          "<3 - @ecb_penguin",
+		LogLevel:            "info",
+		MaxConcurrent:       runtime.NumCPU(),
+		MaxQueued:           64,
+		QueueTimeout:        10 * time.Second,
+		RateBurst:           10,
+		JobWorkers:          2,
+		JobQueueSize:        16,
+		JobTTL:              time.Hour,
+		JobResultBytes:      256 << 20,
+		JobCallbackTimeout:  10 * time.Second,
+		FetchSchemes:        []string{"https"},
+		FetchTimeout:        10 * time.Second,
+		FetchMaxBytes:       16 << 20,
+		FetchMaxRedirects:   3,
+		BatchMaxFiles:       100,
+		BatchMaxBytes:       256 << 20,
+		CacheBytes:          64 << 20,
+		StoreTTL:            24 * time.Hour,
+		StoreMaxBytes:       256 << 20,
+		ShutdownGracePeriod: 30 * time.Second,
+	}
+}
+
+// setting describes one config setting. The name is used as both the config
+// file key and the command line flag name.
+type setting struct {
+	name  string
+	env   string
+	usage string
+	// field returns a pointer to the config struct field for this setting. It
+	// must be a *string, *bool, *time.Duration, *int, *int64 or *[]string.
+	field func(c *config) interface{}
+}
+
+// settings lists every config setting
+var settings = []setting{
+	{
+		name:  "listen",
+		env:   "ECBB_LISTEN",
+		usage: "Bind address/port for HTTP server, or unix:/path/to.sock",
+		field: func(c *config) interface{} { return &c.Listen },
+	},
+	{
+		name:  "listenSocketMode",
+		env:   "ECBB_LISTEN_SOCKET_MODE",
+		usage: "Octal file mode of a unix: listen socket",
+		field: func(c *config) interface{} { return &c.ListenSocketMode },
+	},
+	{
+		name:  "tlsCert",
+		env:   "ECBB_TLS_CERT",
+		usage: "PEM certificate file to serve HTTPS with (needs tlsKey)",
+		field: func(c *config) interface{} { return &c.TLSCert },
+	},
+	{
+		name:  "tlsKey",
+		env:   "ECBB_TLS_KEY",
+		usage: "PEM private key file for tlsCert",
+		field: func(c *config) interface{} { return &c.TLSKey },
+	},
+	{
+		name:  "tlsSelfSigned",
+		env:   "ECBB_TLS_SELF_SIGNED",
+		usage: "Serve HTTPS with a generated self-signed certificate (development only)",
+		field: func(c *config) interface{} { return &c.TLSSelfSigned },
+	},
+	{
+		name:  "tlsSelfSignedCertFile",
+		env:   "ECBB_TLS_SELF_SIGNED_CERT_FILE",
+		usage: "File to write the generated self-signed certificate to",
+		field: func(c *config) interface{} { return &c.TLSSelfSignedCertFile },
+	},
+	{
+		name:  "tlsClientCA",
+		env:   "ECBB_TLS_CLIENT_CA",
+		usage: "PEM CA certificate file, clients must present a certificate it signed",
+		field: func(c *config) interface{} { return &c.TLSClientCA },
+	},
+	{
+		name:  "readHeaderTimeout",
+		env:   "ECBB_READ_HEADER_TIMEOUT",
+		usage: "Time allowed to read request headers",
+		field: func(c *config) interface{} { return &c.ReadHeaderTimeout },
+	},
+	{
+		name:  "readTimeout",
+		env:   "ECBB_READ_TIMEOUT",
+		usage: "Time allowed to read an entire request",
+		field: func(c *config) interface{} { return &c.ReadTimeout },
+	},
+	{
+		name:  "writeTimeout",
+		env:   "ECBB_WRITE_TIMEOUT",
+		usage: "Time allowed to read a request and write the response",
+		field: func(c *config) interface{} { return &c.WriteTimeout },
+	},
+	{
+		name:  "idleTimeout",
+		env:   "ECBB_IDLE_TIMEOUT",
+		usage: "Time a keep-alive connection may sit idle",
+		field: func(c *config) interface{} { return &c.IdleTimeout },
+	},
+	{
+		name:  "maxBodyBytes",
+		env:   "ECBB_MAX_BODY_BYTES",
+		usage: "Largest request body accepted, in bytes",
+		field: func(c *config) interface{} { return &c.MaxBodyBytes },
+	},
+	{
+		name:  "maxPixels",
+		env:   "ECBB_MAX_PIXELS",
+		usage: "Largest image decoded, in pixels (width times height)",
+		field: func(c *config) interface{} { return &c.MaxPixels },
+	},
+	{
+		name:  "maxHeaderBytes",
+		env:   "ECBB_MAX_HEADER_BYTES",
+		usage: "Largest total size of request headers accepted, in bytes",
+		field: func(c *config) interface{} { return &c.MaxHeaderBytes },
+	},
+	{
+		name:  "defaultKey",
+		env:   "ECBB_DEFAULT_KEY",
+		usage: "Key used when a request doesn't provide one",
+		field: func(c *config) interface{} { return &c.DefaultKey },
+	},
+	{
+		name:  "requireKey",
+		env:   "ECBB_REQUIRE_KEY",
+		usage: "Reject requests that don't provide a key instead of using the default key",
+		field: func(c *config) interface{} { return &c.RequireKey },
+	},
+	{
+		name:  "minKeyLength",
+		env:   "ECBB_MIN_KEY_LENGTH",
+		usage: "Shortest key (in characters) accepted from a request, 0 for no limit",
+		field: func(c *config) interface{} { return &c.MinKeyLength },
+	},
+	{
+		name:  "maxKeyLength",
+		env:   "ECBB_MAX_KEY_LENGTH",
+		usage: "Longest key (in characters) accepted from a request, 0 for no limit",
+		field: func(c *config) interface{} { return &c.MaxKeyLength },
+	},
+	{
+		name:  "bannedKeys",
+		env:   "ECBB_BANNED_KEYS",
+		usage: "Comma separated keys that requests aren't allowed to use",
+		field: func(c *config) interface{} { return &c.BannedKeys },
+	},
+	{
+		name:  "logLevel",
+		env:   "ECBB_LOG_LEVEL",
+		usage: "Least severe log level written: debug, info, warn or error",
+		field: func(c *config) interface{} { return &c.LogLevel },
+	},
+	{
+		name:  "logKeyFingerprints",
+		env:   "ECBB_LOG_KEY_FINGERPRINTS",
+		usage: "Log a salted fingerprint of each request's key",
+		field: func(c *config) interface{} { return &c.LogKeyFingerprints },
+	},
+	{
+		name:  "keyFingerprintSalt",
+		env:   "ECBB_KEY_FINGERPRINT_SALT",
+		usage: "Salt for key fingerprints (random if empty)",
+		field: func(c *config) interface{} { return &c.KeyFingerprintSalt },
+	},
+	{
+		name:  "maxConcurrent",
+		env:   "ECBB_MAX_CONCURRENT",
+		usage: "Number of CPU heavy requests run at once",
+		field: func(c *config) interface{} { return &c.MaxConcurrent },
+	},
+	{
+		name:  "maxQueued",
+		env:   "ECBB_MAX_QUEUED",
+		usage: "Number of CPU heavy requests that can wait to run",
+		field: func(c *config) interface{} { return &c.MaxQueued },
+	},
+	{
+		name:  "queueTimeout",
+		env:   "ECBB_QUEUE_TIMEOUT",
+		usage: "Time a request can wait to run before it's turned away",
+		field: func(c *config) interface{} { return &c.QueueTimeout },
+	},
+	{
+		name:  "rateLimit",
+		env:   "ECBB_RATE_LIMIT",
+		usage: "Requests a minute allowed per client IP, 0 for no limit",
+		field: func(c *config) interface{} { return &c.RateLimit },
+	},
+	{
+		name:  "rateBurst",
+		env:   "ECBB_RATE_BURST",
+		usage: "Requests a client IP can make at once",
+		field: func(c *config) interface{} { return &c.RateBurst },
+	},
+	{
+		name:  "trustedProxies",
+		env:   "ECBB_TRUSTED_PROXIES",
+		usage: "Comma separated IPs/CIDRs of proxies whose X-Forwarded-For is trusted",
+		field: func(c *config) interface{} { return &c.TrustedProxies },
+	},
+	{
+		name:  "apiKeysFile",
+		env:   "ECBB_API_KEYS_FILE",
+		usage: "JSON file of API keys to require (reloaded on SIGHUP), empty for no authentication",
+		field: func(c *config) interface{} { return &c.APIKeysFile },
+	},
+	{
+		name:  "disabledFeatures",
+		env:   "ECBB_DISABLED_FEATURES",
+		usage: "Comma separated features (e.g. wav,batch) turned off for everyone",
+		field: func(c *config) interface{} { return &c.DisabledFeatures },
+	},
+	{
+		name:  "auditLogFile",
+		env:   "ECBB_AUDIT_LOG_FILE",
+		usage: "File changes made through the admin API are appended to",
+		field: func(c *config) interface{} { return &c.AuditLogFile },
+	},
+	{
+		name:  "jobWorkers",
+		env:   "ECBB_JOB_WORKERS",
+		usage: "Number of asynchronous jobs run at once",
+		field: func(c *config) interface{} { return &c.JobWorkers },
+	},
+	{
+		name:  "jobQueueSize",
+		env:   "ECBB_JOB_QUEUE_SIZE",
+		usage: "Number of asynchronous jobs that can wait for a worker",
+		field: func(c *config) interface{} { return &c.JobQueueSize },
+	},
+	{
+		name:  "jobTTL",
+		env:   "ECBB_JOB_TTL",
+		usage: "How long finished jobs and their results are kept",
+		field: func(c *config) interface{} { return &c.JobTTL },
+	},
+	{
+		name:  "jobResultBytes",
+		env:   "ECBB_JOB_RESULT_BYTES",
+		usage: "Memory budget for the images of queued jobs and the results of finished ones",
+		field: func(c *config) interface{} { return &c.JobResultBytes },
+	},
+	{
+		name:  "jobCallbackTimeout",
+		env:   "ECBB_JOB_CALLBACK_TIMEOUT",
+		usage: "Time allowed for a job's completion callback to respond",
+		field: func(c *config) interface{} { return &c.JobCallbackTimeout },
+	},
+	{
+		name:  "jobCallbackAllowPrivate",
+		env:   "ECBB_JOB_CALLBACK_ALLOW_PRIVATE",
+		usage: "Let job callbacks reach loopback, private and link-local addresses (unsafe)",
+		field: func(c *config) interface{} { return &c.JobCallbackAllowPrivate },
+	},
+	{
+		name:  "fetchSchemes",
+		env:   "ECBB_FETCH_SCHEMES",
+		usage: "Comma separated URL schemes imageURL can use, empty to turn imageURL off",
+		field: func(c *config) interface{} { return &c.FetchSchemes },
+	},
+	{
+		name:  "fetchTimeout",
+		env:   "ECBB_FETCH_TIMEOUT",
+		usage: "Time allowed to fetch an imageURL",
+		field: func(c *config) interface{} { return &c.FetchTimeout },
+	},
+	{
+		name:  "fetchMaxBytes",
+		env:   "ECBB_FETCH_MAX_BYTES",
+		usage: "Largest image fetched from an imageURL, in bytes",
+		field: func(c *config) interface{} { return &c.FetchMaxBytes },
+	},
+	{
+		name:  "fetchMaxRedirects",
+		env:   "ECBB_FETCH_MAX_REDIRECTS",
+		usage: "Number of redirects followed when fetching an imageURL",
+		field: func(c *config) interface{} { return &c.FetchMaxRedirects },
+	},
+	{
+		name:  "fetchAllowPrivate",
+		env:   "ECBB_FETCH_ALLOW_PRIVATE",
+		usage: "Let imageURL reach loopback, private and link-local addresses (unsafe)",
+		field: func(c *config) interface{} { return &c.FetchAllowPrivate },
+	},
+	{
+		name:  "batchMaxFiles",
+		env:   "ECBB_BATCH_MAX_FILES",
+		usage: "Most images accepted by one /v1/batch request",
+		field: func(c *config) interface{} { return &c.BatchMaxFiles },
+	},
+	{
+		name:  "batchMaxBytes",
+		env:   "ECBB_BATCH_MAX_BYTES",
+		usage: "Largest total uncompressed size of the images in a /v1/batch request, in bytes",
+		field: func(c *config) interface{} { return &c.BatchMaxBytes },
+	},
+	{
+		name:  "cacheBytes",
+		env:   "ECBB_CACHE_BYTES",
+		usage: "Memory budget for cached results, in bytes, 0 to turn the cache off",
+		field: func(c *config) interface{} { return &c.CacheBytes },
+	},
+	{
+		name:  "cacheDir",
+		env:   "ECBB_CACHE_DIR",
+		usage: "Directory to persist cached results in",
+		field: func(c *config) interface{} { return &c.CacheDir },
+	},
+	{
+		name:  "store",
+		env:   "ECBB_STORE",
+		usage: "Where to save results requested with store: memory or dir, empty to turn storing off",
+		field: func(c *config) interface{} { return &c.Store },
+	},
+	{
+		name:  "storeDir",
+		env:   "ECBB_STORE_DIR",
+		usage: "Directory to save stored results in when store is dir",
+		field: func(c *config) interface{} { return &c.StoreDir },
+	},
+	{
+		name:  "storeTTL",
+		env:   "ECBB_STORE_TTL",
+		usage: "Time stored results are kept",
+		field: func(c *config) interface{} { return &c.StoreTTL },
+	},
+	{
+		name:  "storeMaxBytes",
+		env:   "ECBB_STORE_MAX_BYTES",
+		usage: "Most bytes of stored results kept at once",
+		field: func(c *config) interface{} { return &c.StoreMaxBytes },
+	},
+	{
+		name:  "publicURL",
+		env:   "ECBB_PUBLIC_URL",
+		usage: "Public base URL of the server, for absolute links to stored results",
+		field: func(c *config) interface{} { return &c.PublicURL },
+	},
+	{
+		name:  "shutdownDelay",
+		env:   "ECBB_SHUTDOWN_DELAY",
+		usage: "Time /readyz fails for before the server stops accepting connections on shutdown",
+		field: func(c *config) interface{} { return &c.ShutdownDelay },
+	},
+	{
+		name:  "shutdownGracePeriod",
+		env:   "ECBB_SHUTDOWN_GRACE_PERIOD",
+		usage: "Time in-flight requests and jobs get to finish on shutdown",
+		field: func(c *config) interface{} { return &c.ShutdownGracePeriod },
+	},
+}
+
+// findSetting returns the setting with the given name, or nil if there isn't
+// one
+func findSetting(name string) *setting {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// set parses raw and stores it in the config field for the setting
+func (s setting) set(c *config, raw string) error {
+	switch v := s.field(c).(type) {
+	case *string:
+		*v = raw
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		*v = b
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item != "" {
+				*v = append(*v, item)
+			}
+		}
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (e.g. \"30s\")", raw)
+		}
+		*v = d
+	case *int:
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		*v = i
+	case *int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		*v = i
+	default:
+		panic(fmt.Sprintf("setting %q has unsupported field type %T", s.name, v))
+	}
+	return nil
+}
+
+// get returns the config field for the setting formatted as a string
+func (s setting) get(c *config) string {
+	switch v := s.field(c).(type) {
+	case *string:
+		return *v
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *[]string:
+		return strings.Join(*v, ",")
+	case *time.Duration:
+		return v.String()
+	case *int:
+		return strconv.Itoa(*v)
+	case *int64:
+		return strconv.FormatInt(*v, 10)
+	default:
+		panic(fmt.Sprintf("setting %q has unsupported field type %T", s.name, v))
+	}
+}
+
+// settingError describes a setting that couldn't be loaded or is invalid
+type settingError struct {
+	setting string
+	source  string
+	err     error
+}
+
+func (e settingError) Error() string {
+	if e.source == "" {
+		return fmt.Sprintf("invalid setting %q: %s", e.setting, e.err)
+	}
+	return fmt.Sprintf("invalid setting %q from %s: %s", e.setting, e.source, e.err)
+}
+
+// loadConfig builds the server config from the defaults, the config file named
+// by the `-config` flag (if any), the environment and the command line args
+func loadConfig(args []string) (config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("ecbb", flag.ExitOnError)
+	configFile := fs.String("config", "", "JSON config file to load settings from")
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		// Boolean flags are registered as such so that e.g. `-requireKey` works
+		// without an explicit value
+		if b, ok := s.field(&cfg).(*bool); ok {
+			fs.Bool(s.name, *b, usage)
+			continue
+		}
+		fs.String(s.name, s.get(&cfg), usage)
+	}
+	fs.Parse(args)
+
+	if *configFile != "" {
+		if err := loadConfigFile(&cfg, *configFile); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(&cfg, raw); err != nil {
+				return cfg, settingError{s.name, "environment variable " + s.env, err}
+			}
+		}
+	}
+
+	// Only flags that were explicitly given on the command line override the
+	// config file and environment. The rest are just showing their defaults.
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		s := findSetting(f.Name)
+		if s == nil || flagErr != nil {
+			return
+		}
+		if err := s.set(&cfg, f.Value.String()); err != nil {
+			flagErr = settingError{s.name, "flag -" + s.name, err}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	return cfg, cfg.validate()
+}
+
+// loadConfigFile reads settings from a JSON object in the named file. Values
+// are written the same way as they would be for a flag, e.g.
+//
+//	{"listen": "localhost:6969", "readTimeout": "30s", "maxBodyBytes": 1048576}
+func loadConfigFile(cfg *config, filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("config file %q: %s", filename, err)
+	}
+
+	source := fmt.Sprintf("config file %q", filename)
+	for name, rawValue := range values {
+		s := findSetting(name)
+		if s == nil {
+			return settingError{name, source, errors.New("unknown setting")}
+		}
+		if err := s.setJSON(cfg, rawValue); err != nil {
+			return settingError{name, source, err}
+		}
+	}
+	return nil
+}
+
+// setJSON stores a JSON value in the config field for the setting. Values are
+// written the same way as they would be for a flag, but lists can also be
+// JSON arrays so that items may contain commas.
+func (s setting) setJSON(c *config, rawValue json.RawMessage) error {
+	if list, ok := s.field(c).(*[]string); ok {
+		// A new slice, so a copied config's list isn't overwritten in place
+		var items []string
+		if json.Unmarshal(rawValue, &items) == nil {
+			*list = items
+			return nil
+		}
+	}
+	// Strings are unquoted, anything else (e.g. numbers) is used as-is
+	raw := string(rawValue)
+	var str string
+	if json.Unmarshal(rawValue, &str) == nil {
+		raw = str
+	}
+	return s.set(c, raw)
+}
+
+// validate checks that the loaded settings make sense
+func (c config) validate() error {
+	if c.Listen == "" {
+		return settingError{"listen", "", errors.New("must not be empty")}
+	}
+	if c.Listen == unixListenPrefix {
+		return settingError{"listen", "", errors.New("needs a socket path after unix:")}
+	}
+	if _, err := parseSocketMode(c.ListenSocketMode); err != nil {
+		return settingError{"listenSocketMode", "", err}
+	}
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"readHeaderTimeout", c.ReadHeaderTimeout},
+		{"readTimeout", c.ReadTimeout},
+		{"writeTimeout", c.WriteTimeout},
+		{"idleTimeout", c.IdleTimeout},
+		{"queueTimeout", c.QueueTimeout},
+		{"jobTTL", c.JobTTL},
+		{"jobCallbackTimeout", c.JobCallbackTimeout},
+		{"shutdownGracePeriod", c.ShutdownGracePeriod},
+		{"fetchTimeout", c.FetchTimeout},
+		{"storeTTL", c.StoreTTL},
+	}
+	for _, t := range timeouts {
+		if t.value <= 0 {
+			return settingError{t.name, "", fmt.Errorf("must be greater than zero, got %s", t.value)}
+		}
+	}
+	for _, scheme := range c.FetchSchemes {
+		if scheme != "http" && scheme != "https" {
+			return settingError{"fetchSchemes", "", fmt.Errorf("only http and https are supported, got %q", scheme)}
+		}
+	}
+	if c.FetchMaxBytes <= 0 {
+		return settingError{"fetchMaxBytes", "", fmt.Errorf("must be greater than zero, got %d", c.FetchMaxBytes)}
+	}
+	if c.FetchMaxRedirects < 0 {
+		return settingError{"fetchMaxRedirects", "", fmt.Errorf("must not be negative, got %d", c.FetchMaxRedirects)}
+	}
+	if c.BatchMaxFiles <= 0 {
+		return settingError{"batchMaxFiles", "", fmt.Errorf("must be greater than zero, got %d", c.BatchMaxFiles)}
+	}
+	if c.BatchMaxBytes <= 0 {
+		return settingError{"batchMaxBytes", "", fmt.Errorf("must be greater than zero, got %d", c.BatchMaxBytes)}
+	}
+	if c.CacheBytes < 0 {
+		return settingError{"cacheBytes", "", fmt.Errorf("must not be negative, got %d", c.CacheBytes)}
+	}
+	if c.CacheDir != "" && c.CacheBytes == 0 {
+		return settingError{"cacheDir", "", errors.New("needs cacheBytes to be greater than zero")}
+	}
+	if err := c.validateStore(); err != nil {
+		return err
+	}
+	if c.ShutdownDelay < 0 {
+		return settingError{"shutdownDelay", "", fmt.Errorf("must not be negative, got %s", c.ShutdownDelay)}
+	}
+	if c.MaxBodyBytes <= 0 {
+		return settingError{"maxBodyBytes", "", fmt.Errorf("must be greater than zero, got %d", c.MaxBodyBytes)}
+	}
+	if c.MaxPixels <= 0 {
+		return settingError{"maxPixels", "", fmt.Errorf("must be greater than zero, got %d", c.MaxPixels)}
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return settingError{"maxHeaderBytes", "", fmt.Errorf("must be greater than zero, got %d", c.MaxHeaderBytes)}
+	}
+	if c.MinKeyLength < 0 {
+		return settingError{"minKeyLength", "", fmt.Errorf("must not be negative, got %d", c.MinKeyLength)}
+	}
+	if c.MaxKeyLength < 0 {
+		return settingError{"maxKeyLength", "", fmt.Errorf("must not be negative, got %d", c.MaxKeyLength)}
+	}
+	if c.MaxKeyLength > 0 && c.MinKeyLength > c.MaxKeyLength {
+		return settingError{"minKeyLength", "", fmt.Errorf(
+			"must not be greater than maxKeyLength (%d), got %d", c.MaxKeyLength, c.MinKeyLength)}
+	}
+	if c.DefaultKey == "" && !c.RequireKey {
+		return settingError{"defaultKey", "", errors.New("must not be empty unless requireKey is true")}
+	}
+	if c.MaxConcurrent <= 0 {
+		return settingError{"maxConcurrent", "", fmt.Errorf("must be greater than zero, got %d", c.MaxConcurrent)}
+	}
+	if c.MaxQueued < 0 {
+		return settingError{"maxQueued", "", fmt.Errorf("must not be negative, got %d", c.MaxQueued)}
+	}
+	if c.RateLimit < 0 {
+		return settingError{"rateLimit", "", fmt.Errorf("must not be negative, got %d", c.RateLimit)}
+	}
+	if c.RateLimit > 0 && c.RateBurst <= 0 {
+		return settingError{"rateBurst", "", fmt.Errorf("must be greater than zero, got %d", c.RateBurst)}
+	}
+	for _, f := range c.DisabledFeatures {
+		if !knownFeatures[f] || f == featureAll || f == featureAdmin {
+			return settingError{"disabledFeatures", "", fmt.Errorf("can't turn off %q", f)}
+		}
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return settingError{"trustedProxies", "", err}
+	}
+	if c.JobWorkers <= 0 {
+		return settingError{"jobWorkers", "", fmt.Errorf("must be greater than zero, got %d", c.JobWorkers)}
+	}
+	if c.JobQueueSize < 0 {
+		return settingError{"jobQueueSize", "", fmt.Errorf("must not be negative, got %d", c.JobQueueSize)}
+	}
+	if c.JobResultBytes <= 0 {
+		return settingError{"jobResultBytes", "", fmt.Errorf("must be greater than zero, got %d", c.JobResultBytes)}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return settingError{"logLevel", "", fmt.Errorf("must be debug, info, warn or error, got %q", c.LogLevel)}
+	}
+	return nil
+}
+
+// validateStore checks the result store settings
+func (c config) validateStore() error {
+	switch c.Store {
+	case "", storeMemory:
+		if c.StoreDir != "" {
+			return settingError{"storeDir", "", errors.New("needs store to be dir")}
+		}
+	case storeDir:
+		if c.StoreDir == "" {
+			return settingError{"storeDir", "", errors.New("must be set when store is dir")}
+		}
+	default:
+		return settingError{"store", "", fmt.Errorf("must be memory, dir or empty, got %q", c.Store)}
+	}
+	if c.StoreMaxBytes <= 0 {
+		return settingError{"storeMaxBytes", "", fmt.Errorf("must be greater than zero, got %d", c.StoreMaxBytes)}
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return settingError{"publicURL", "", fmt.Errorf("must be an absolute http or https URL, got %q", c.PublicURL)}
+		}
+	}
+	return nil
+}
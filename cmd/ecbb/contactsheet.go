@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxContactSheetKeys limits how many times one request can make us encrypt
+	// an image
+	maxContactSheetKeys = 16
+	// defaultCellSize is the largest width or height (in pixels) of each image
+	// on a contact sheet when the caller doesn't pick one
+	defaultCellSize = 320
+	// maxCellSize keeps contact sheets to a sane size
+	maxCellSize = 1024
+	// sheetPadding is the space (in pixels) around every cell of a contact sheet
+	sheetPadding = 12
+	// captionScale is how many pixels wide each font pixel is in captions
+	captionScale = 2
+)
+
+var (
+	sheetBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	captionColor    = color.RGBA{0x00, 0x00, 0x00, 0xff}
+)
+
+// parseContactSheetKeys returns the keys a contact sheet should be made with.
+// A single `keys` form value is split on commas. When `keys` is given more
+// than once every value is used as-is so that keys can contain commas. Every
+// key must pass the key policy.
+func (s *server) parseContactSheetKeys(r *http.Request) ([]string, error) {
+	values := r.Form["keys"]
+	if len(values) == 1 {
+		values = strings.Split(values[0], ",")
+	}
+	var keys []string
+	for _, k := range values {
+		if k == "" {
+			continue
+		}
+		if err := s.checkKey(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("at least one \"keys\" value is required")
+	}
+	if len(keys) > maxContactSheetKeys {
+		return nil, fmt.Errorf("too many \"keys\" (%d), the maximum is %d",
+			len(keys), maxContactSheetKeys)
+	}
+	return keys, nil
+}
+
+// parseCellSize reads the optional `cellSize` form value from a request
+func parseCellSize(r *http.Request) (int, error) {
+	raw := r.FormValue("cellSize")
+	if raw == "" {
+		return defaultCellSize, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 1 || v > maxCellSize {
+		return 0, fmt.Errorf("\"cellSize\" must be an integer between 1 and %d", maxCellSize)
+	}
+	return v, nil
+}
+
+// fitCaption shortens text with a trailing "..." until it fits in width
+// pixels at `captionScale`
+func fitCaption(text string, width int) string {
+	if textWidth(text, captionScale) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		caption := string(runes) + "..."
+		if textWidth(caption, captionScale) <= width {
+			return caption
+		}
+	}
+	return ""
+}
+
+// contactSheet encrypts rgba once per key using the given pixel layout and lays
+// the results out in a grid with each key as a caption underneath its image.
+// The time spent encrypting and the block counts of every key are added to d.
+func contactSheet(rgba *image.RGBA, keys []string, layout pixelLayout, d *diagnostics) (*image.RGBA, error) {
+	cellW, cellH := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	columns := int(math.Ceil(math.Sqrt(float64(len(keys)))))
+	rows := (len(keys) + columns - 1) / columns
+	captionH := textHeight(captionScale) + sheetPadding/2
+
+	sheet := image.NewRGBA(image.Rect(0, 0,
+		columns*(cellW+sheetPadding)+sheetPadding,
+		rows*(cellH+captionH+sheetPadding)+sheetPadding))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{sheetBackground}, image.Point{}, draw.Src)
+
+	for i, key := range keys {
+		start := time.Now()
+		ecbImage, stats, err := layout.encrypt(rgba, key)
+		if err != nil {
+			return nil, err
+		}
+		d.timings.observe(start, "encrypt", "ecbEncryptBytes")
+		d.stats.add(stats)
+		x := sheetPadding + (i%columns)*(cellW+sheetPadding)
+		y := sheetPadding + (i/columns)*(cellH+captionH+sheetPadding)
+		cell := image.Rect(x, y, x+cellW, y+cellH)
+		draw.Draw(sheet, cell, ecbImage, ecbImage.Bounds().Min, draw.Src)
+
+		caption := fitCaption(key, cellW)
+		captionX := x + (cellW-textWidth(caption, captionScale))/2
+		drawText(sheet, image.Pt(captionX, y+cellH+sheetPadding/2), caption, captionColor, captionScale)
+	}
+	return sheet, nil
+}
+
+// contactSheetECB is an HTTP handler that processes a multi-part form
+// submission with an `image` and a list of `keys`. It returns a PNG contact
+// sheet of the image encrypted with each of the keys.
+func (s *server) contactSheetECB(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
+		return
+	}
+
+	if !s.parseForm(w, r) {
+		return
+	}
+
+	keys, err := s.parseContactSheetKeys(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+
+	cellSize, err := parseCellSize(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+
+	layout, err := parseLayout(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		s.writeError(w, r, newAPIError(http.StatusBadRequest, codeMissingField,
+			"missing \"image\" upload", err))
+		return
+	}
+	defer file.Close()
+
+	// Decoding is part of the work, like it is for `/new`
+	start := time.Now()
+	release, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	d := diagnostics{queueWait: time.Since(start)}
+
+	start = time.Now()
+	img, format, err := parseReaderToImage(file, s.config().MaxPixels)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	d.timings.observe(start, "decode", "image.Decode")
+
+	bounds := (*img).Bounds()
+	d.inputFormat, d.inputWidth, d.inputHeight = format, bounds.Dx(), bounds.Dy()
+	addLogAttrs(r,
+		slog.String("format", format),
+		slog.Int("width", bounds.Dx()),
+		slog.Int("height", bounds.Dy()),
+		slog.String("layout", layout.name),
+		slog.Int("keys", len(keys)))
+
+	// Shrink the image to fit a cell *before* encrypting it. Resampling the
+	// ciphertext would blur away the very patterns we're trying to show off.
+	start = time.Now()
+	rgba := toRGBA(*img)
+	d.timings.observe(start, "rgba", "toRGBA")
+	start = time.Now()
+	rgba = downscale(rgba, resizeOptions{
+		maxWidth:  cellSize,
+		maxHeight: cellSize,
+		filter:    catmullRomFilter,
+	})
+	d.timings.observe(start, "resize", "downscale")
+	sheet, err := contactSheet(rgba, keys, layout, &d)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.writePNG(w, r, sheet, d)
+}
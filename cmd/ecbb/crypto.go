@@ -1,20 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha1"
 	"fmt"
-	"image"
 )
 
-// ecbEncrypt takes an input RGBA image and a fixed key and returns the image
-// encrypted using AES 128 in ECB mode with a key derived from the key string
-func ecbEncrypt(rgba image.RGBA, key string) (image.Image, error) {
-	// Everything is an ECB Penguin if you squint hard enough
-	penguin := image.NewRGBA(rgba.Bounds())
-
+// ecbEncryptBytes zero pads the plaintext to the AES block size and encrypts
+// it using AES 128 in ECB mode with a key derived from the key string
+func ecbEncryptBytes(plaintext []byte, key string) ([]byte, error) {
 	// Turn the "key" string into a 16 byte AES key by computing the SHA1 sum and
 	// slicing the first 16 bytes. This is a *terrible* key derivation strategy!
 	// Don't do this unless you're writing a twitter bot that deliberately uses
@@ -31,13 +26,11 @@ func ecbEncrypt(rgba image.RGBA, key string) (image.Image, error) {
 	// Wrap it in the ECB block cipher mode
 	e := newECBBlockCipher(blockCipher)
 
-	srcBytes := pad(rgba.Pix, e.BlockSize())
+	srcBytes := pad(plaintext, e.BlockSize())
 
-	// Encrypt the image data into a buffer
 	encryptedBytes := make([]byte, len(srcBytes))
 	e.CryptBlocks(encryptedBytes, srcBytes)
-	penguin.Pix = encryptedBytes
-	return penguin, nil
+	return encryptedBytes, nil
 }
 
 // ecbBlockcipher is a struct wrapping a block cipher to operate in ECB mode
@@ -55,11 +48,13 @@ func newECBBlockCipher(cipher cipher.Block) cipher.BlockMode {
 
 // pad() will zero pad a plaintext message until it is a multiple of the block
 // cipher blocksize. this is a terrible idea unless you're writing a shitty
-// crypto twitter bot!
+// crypto twitter bot! The padded message is always a new slice so that
+// plaintext (which may be a sub-slice of something bigger) is never clobbered.
 func pad(plaintext []byte, blockSize int) []byte {
 	padding := blockSize - len(plaintext)%blockSize
-	padtext := bytes.Repeat([]byte{0}, padding)
-	return append(plaintext, padtext...)
+	padded := make([]byte, len(plaintext)+padding)
+	copy(padded, plaintext)
+	return padded
 }
 
 // CryptBlocks is implemented to operate in ECB mode. It will panic if the input
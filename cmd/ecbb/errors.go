@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Machine readable error codes returned in JSON error bodies
+const (
+	codeBadRequest       = "bad_request"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeMissingField     = "missing_field"
+	codeInvalidOption    = "invalid_option"
+	codeInvalidKey       = "invalid_key"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeFeatureDisabled  = "feature_disabled"
+	codeNotFound         = "not_found"
+	codeNotReady         = "not_ready"
+	codeTooLarge         = "too_large"
+	codeRateLimited      = "rate_limited"
+	codeUnsupportedMedia = "unsupported_media_type"
+	codeUnprocessable    = "unprocessable_input"
+	codeInternal         = "internal_error"
+	codeFetchFailed      = "fetch_failed"
+	codeUnavailable      = "unavailable"
+)
+
+// internalErrorMessage is the message returned for server faults. The real
+// cause is logged, never returned to the client.
+const internalErrorMessage = "An internal server error has occurred"
+
+// apiError is an error that knows which HTTP status and error code it should be
+// reported to the client with. The decode, validate and encrypt stages return
+// apiErrors so that handlers don't have to guess whose fault an error was.
+type apiError struct {
+	status  int
+	code    string
+	message string
+	// cause is the underlying error, if any. It's logged but for server faults
+	// it isn't returned to the client.
+	cause error
+	// allow lists the methods sent in the `Allow` header of a 405
+	allow []string
+	// retryAfter is sent in the `Retry-After` header, if it's set
+	retryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	if e.cause != nil && e.cause.Error() != e.message {
+		return e.message + ": " + e.cause.Error()
+	}
+	return e.message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.cause
+}
+
+// newAPIError returns an apiError with a message for the client and an
+// optional underlying cause
+func newAPIError(status int, code, message string, cause error) *apiError {
+	return &apiError{status: status, code: code, message: message, cause: cause}
+}
+
+// classify returns err as an *apiError. If err already is (or wraps) an
+// apiError that is returned unchanged, otherwise err is wrapped with the given
+// status and code using err's message.
+func classify(err error, status int, code string) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return newAPIError(status, code, err.Error(), err)
+}
+
+// internalError wraps err as a 500 without exposing its message to the client
+func internalError(err error) *apiError {
+	return newAPIError(http.StatusInternalServerError, codeInternal, internalErrorMessage, err)
+}
+
+// errorBody is the JSON body written for every error response
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// writeError logs err and writes it to the client as a JSON error body. Errors
+// that aren't apiErrors are treated as server faults.
+func (s *server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = internalError(err)
+	}
+	logRequestError(r, apiErr.Error())
+	addLogAttrs(r, slog.String("error_code", apiErr.code))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if apiErr.status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", strings.Join(apiErr.allow, ", "))
+	}
+	if apiErr.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ecbb"`)
+	}
+	if apiErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.retryAfter.Seconds()))))
+	}
+	w.WriteHeader(apiErr.status)
+	json.NewEncoder(w).Encode(errorBody{
+		Code:      apiErr.code,
+		Message:   apiErr.message,
+		RequestID: requestID(r),
+	})
+}
+
+// requirePOST writes a 405 error and returns false if the request method isn't
+// POST
+func (s *server) requirePOST(w http.ResponseWriter, r *http.Request) bool {
+	return s.requireMethod(w, r, http.MethodPost)
+}
+
+// requireMethod writes a 405 error and returns false if the request method
+// isn't one of the allowed methods
+func (s *server) requireMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+	s.writeError(w, r, &apiError{
+		status:  http.StatusMethodNotAllowed,
+		code:    codeMethodNotAllowed,
+		message: "Unsupported HTTP method " + r.Method + " - use " + strings.Join(allowed, " or "),
+		allow:   allowed,
+	})
+	return false
+}
+
+// writePNG encodes img as a PNG and writes it as the response, with
+// diagnostic headers from d plus the time taken to encode it and its size.
+// Encoding into a buffer first means an encoding failure can still be
+// reported as an error response instead of a truncated image.
+func (s *server) writePNG(w http.ResponseWriter, r *http.Request, img image.Image, d diagnostics) {
+	start := time.Now()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		s.writeError(w, r, internalError(err))
+		return
+	}
+	d.timings.observe(start, "encode", "png.Encode")
+	d.outputWidth, d.outputHeight = img.Bounds().Dx(), img.Bounds().Dy()
+	setDiagnosticHeaders(w, d)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// fetchUserAgent is the User-Agent sent when fetching an `imageURL`
+const fetchUserAgent = "ecbb (+https://github.com/cpu/ecbb)"
+
+// fetchContentTypes are the content types accepted from an `imageURL`
+var fetchContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+}
+
+// blockedPrefixes are special purpose ranges the server may not connect to
+// on top of the loopback, private, link-local, multicast and unspecified
+// addresses that netip already knows about
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, could reach private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4, could reach private IPv4
+	netip.MustParsePrefix("100::/64"),       // discard-only
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+}
+
+// blockedAddr returns true if addr is somewhere an `imageURL` or job callback
+// shouldn't be able to reach, like the server itself or the network it's on
+func blockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedAddrError is returned when a fetch or job callback tries to connect
+// to a blocked address
+type blockedAddrError struct {
+	addr netip.Addr
+}
+
+func (e *blockedAddrError) Error() string {
+	return fmt.Sprintf("connecting to %s is not allowed", e.addr)
+}
+
+// guardedDialer returns a dialer that refuses to connect to blocked
+// addresses, unless allowPrivate is set
+func guardedDialer(timeout time.Duration, allowPrivate bool) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		// Control runs after DNS resolution, just before connecting, so
+		// this also catches names that resolve (or rebind) to blocked
+		// addresses
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if blockedAddr(addrPort.Addr()) {
+				return &blockedAddrError{addrPort.Addr()}
+			}
+			return nil
+		}
+	}
+	return dialer
+}
+
+// fetcher downloads images from the URLs given to `/new` as `imageURL`.
+// Clients could use it to make the server reach places they can't (SSRF), so
+// it only speaks the allowed schemes, limits time and size, and checks every
+// address it connects to after DNS resolution, including after redirects.
+type fetcher struct {
+	client   *http.Client
+	maxBytes int64
+	schemes  map[string]bool
+}
+
+// newFetcher creates a fetcher using the fetch settings from cfg
+func newFetcher(cfg config) *fetcher {
+	f := &fetcher{
+		maxBytes: cfg.FetchMaxBytes,
+		schemes:  make(map[string]bool),
+	}
+	for _, scheme := range cfg.FetchSchemes {
+		f.schemes[scheme] = true
+	}
+
+	dialer := guardedDialer(cfg.FetchTimeout, cfg.FetchAllowPrivate)
+	f.client = &http.Client{
+		Timeout: cfg.FetchTimeout,
+		Transport: &http.Transport{
+			// Never use a proxy from the environment, the proxy would make
+			// the connections that are meant to be checked
+			Proxy:                  nil,
+			DialContext:            dialer.DialContext,
+			TLSHandshakeTimeout:    cfg.FetchTimeout,
+			ResponseHeaderTimeout:  cfg.FetchTimeout,
+			MaxResponseHeaderBytes: 64 << 10,
+			MaxIdleConns:           16,
+			IdleConnTimeout:        time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.FetchMaxRedirects {
+				return newAPIError(http.StatusBadGateway, codeFetchFailed,
+					fmt.Sprintf("\"imageURL\" redirected more than %d times", cfg.FetchMaxRedirects), nil)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// enabled returns true if any schemes are allowed, i.e. `imageURL` can be used
+func (f *fetcher) enabled() bool {
+	return len(f.schemes) > 0
+}
+
+// checkURL returns a 400 apiError if a URL (or one it redirected to) can't
+// be fetched
+func (f *fetcher) checkURL(u *url.URL) error {
+	if !f.schemes[u.Scheme] {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			fmt.Sprintf("\"imageURL\" scheme %q is not allowed", u.Scheme), nil)
+	}
+	if u.Host == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"imageURL\" must have a host", nil)
+	}
+	if u.User != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"imageURL\" must not have a username or password", nil)
+	}
+	return nil
+}
+
+// fetch downloads an image. Errors are apiErrors: 400 for URLs that aren't
+// allowed, 413 for images over `FetchMaxBytes`, 415 for responses that
+// aren't a PNG or JPEG, and 502 if the download fails.
+func (f *fetcher) fetch(ctx context.Context, raw string) ([]byte, error) {
+	if !f.enabled() {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"imageURL\" is not allowed by this server, upload the \"image\" instead", nil)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"imageURL\" must be an absolute URL", err)
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"imageURL\" is not a valid URL", err)
+	}
+	req.Header.Set("Accept", "image/png, image/jpeg")
+	req.Header.Set("User-Agent", fetchUserAgent)
+	resp, err := f.client.Do(req)
+	addContextLogAttrs(ctx,
+		slog.String("fetch_host", u.Host),
+		slog.Duration("fetch_duration", time.Since(start)))
+	if err != nil {
+		var apiErr *apiError
+		var blocked *blockedAddrError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &apiErr):
+			return nil, apiErr
+		case errors.As(err, &blocked):
+			return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+				"\"imageURL\" resolves to an address that is not allowed", err)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return nil, newAPIError(http.StatusBadGateway, codeFetchFailed,
+				"fetching \"imageURL\" timed out", err)
+		}
+		return nil, newAPIError(http.StatusBadGateway, codeFetchFailed,
+			"fetching \"imageURL\" failed", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(http.StatusBadGateway, codeFetchFailed,
+			fmt.Sprintf("fetching \"imageURL\" returned %q", resp.Status), nil)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !fetchContentTypes[mediaType] {
+		return nil, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+			fmt.Sprintf("\"imageURL\" must be a PNG or JPEG, it's %q", resp.Header.Get("Content-Type")), nil)
+	}
+	tooLarge := newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+		fmt.Sprintf("\"imageURL\" is larger than %d bytes", f.maxBytes), nil)
+	if resp.ContentLength > f.maxBytes {
+		return nil, tooLarge
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return nil, newAPIError(http.StatusBadGateway, codeFetchFailed,
+			"reading \"imageURL\" failed", err)
+	}
+	if int64(len(data)) > f.maxBytes {
+		return nil, tooLarge
+	}
+	addContextLogAttrs(ctx, slog.Int("fetch_bytes", len(data)))
+	return data, nil
+}
+
+// formImage returns the image to encrypt from a `/new` form: either the
+// `image` upload or whatever `imageURL` points to, but not both
+func (s *server) formImage(r *http.Request) ([]byte, error) {
+	imageURL := r.FormValue("imageURL")
+	file, _, err := r.FormFile("image")
+	switch {
+	case err == nil && imageURL != "":
+		file.Close()
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"send either an \"image\" upload or an \"imageURL\", not both", nil)
+	case imageURL != "":
+		return s.fetcher.fetch(r.Context(), imageURL)
+	case err != nil:
+		return nil, newAPIError(http.StatusBadRequest, codeMissingField,
+			"missing \"image\" upload or \"imageURL\"", err)
+	}
+	defer file.Close()
+
+	image, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeBadRequest,
+			"\"image\" could not be read", err)
+	}
+	return image, nil
+}
@@ -1,79 +1,76 @@
 package main
 
 import (
-	"fmt"
-	"image/png"
 	"net/http"
-	"os"
-	"time"
 )
 
-// logError spits out a message to STDERR
-func logError(msg string, code int) {
-	fmt.Fprintf(os.Stderr, "[!] - %d - %s\n", code, msg)
-}
-
-// logSuccess spits out a message to STDOUT
-func logSuccess(msg string) {
-	fmt.Printf("[*] - 200 - %s\n", msg)
-}
-
 // newECB is an HTTP handler that processes a multi-part form submission and
-// returns an ECB encrypted image
-func newECB(w http.ResponseWriter, r *http.Request) {
-	reqStart := time.Now()
-
-	if r.Method != "POST" {
-		logError(fmt.Sprintf("Unsupported HTTP method %q", r.Method), http.StatusMethodNotAllowed)
-		http.Error(w, "Unsupported HTTP method - use POST", http.StatusMethodNotAllowed)
+// returns an ECB encrypted image. It's the original API, `/v1/encrypt` offers
+// the same thing as JSON. If the `store` field is true the result is also
+// saved and the `X-ECBB-Result-*` headers say where.
+func (s *server) newECB(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
 		return
 	}
 
-	// TODO(@cpu): Set a sane & configurable limit to the form size
-	r.ParseMultipartForm(32 << 20)
-
-	key := r.FormValue("key")
-	if key == "" {
-		// TODO(@cpu): read default key from param/config
-		key = "<3 - @ecb_penguin"
+	if !s.parseForm(w, r) {
+		return
 	}
 
-	file, _, err := r.FormFile("image")
+	key, err := s.requestKey(r)
 	if err != nil {
-		logError(
-			fmt.Sprintf("Error calling FormFile: %s", err.Error()),
-			http.StatusInternalServerError)
-		http.Error(w, "bad \"image\"", http.StatusBadRequest)
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
 		return
 	}
-	defer file.Close()
+	s.logKey(r, key)
 
-	img, err := parseReaderToImage(file)
+	params, err := parseEncryptParams(r)
 	if err != nil {
-		logError(
-			fmt.Sprintf("Error calling parseReaderToImage: %s", err.Error()),
-			http.StatusInternalServerError)
-		http.Error(w, "bad \"image\"", http.StatusInternalServerError)
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
 		return
 	}
+	params.maxPixels = s.config().MaxPixels
 
-	rgba := toRGBA(*img)
-	ecbImage, err := ecbEncrypt(*rgba, key)
+	store, err := wantsStore(r)
 	if err != nil {
-		logError(
-			fmt.Sprintf("Error calling ecbEncrypt: %s", err.Error()),
-			http.StatusInternalServerError)
-		http.Error(w, "An internal server error has occurred",
-			http.StatusInternalServerError)
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
 		return
 	}
+	if store {
+		if err := s.checkStore(r); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
 
-	err = png.Encode(w, ecbImage)
+	image, err := s.formImage(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeError(w, r, err)
+		return
+	}
+
+	in := encryptInput{image: image, key: key, params: params}
+	resultKey := s.cache.key(in)
+	etag := `"` + resultKey + `"`
+	// A client asking for a link needs a new one even if it has the image
+	if !store && s.notModified(w, r, etag) {
 		return
 	}
+	result, ok := s.cachedEncrypt(w, r, in, resultKey)
+	if !ok {
+		return
+	}
+	if store {
+		stored, err := s.storeResult(r, result.png)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+		setStoredHeaders(w, stored)
+	} else {
+		w.Header().Set("ETag", etag)
+	}
 
-	duration := time.Since(reqStart)
-	logSuccess(fmt.Sprintf("Processed ECB image with key %q in %s", key, duration))
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(result.png)
 }
@@ -1,29 +1,50 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"io"
+	"net/http"
 
 	_ "image/jpeg"
 	_ "image/png"
 )
 
-// parseReaderToImage reads from a io.Reader into a decoded image.Image
-func parseReaderToImage(reader io.Reader) (*image.Image, error) {
-	img, format, err := image.Decode(reader)
-	if err != nil {
-		return nil, err
+// parseReaderToImage reads from a io.Reader into a decoded image.Image. The
+// name of the image format (e.g. "png") is also returned. Input that isn't
+// a PNG or JPEG is a 415 apiError, a PNG or JPEG that can't be decoded is
+// a 422. An image with more than maxPixels pixels is a 413, found from its
+// header before anything is allocated for it, since a tiny PNG can claim to
+// be huge.
+func parseReaderToImage(reader io.Reader, maxPixels int64) (*image.Image, string, error) {
+	// Keep what DecodeConfig reads so that Decode can read it again
+	var header bytes.Buffer
+	imgConfig, format, err := image.DecodeConfig(io.TeeReader(reader, &header))
+	if err == nil && int64(imgConfig.Width)*int64(imgConfig.Height) > maxPixels {
+		return nil, "", newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("\"image\" is %dx%d, more than %d pixels",
+				imgConfig.Width, imgConfig.Height, maxPixels), nil)
+	}
+
+	img, format, err := image.Decode(io.MultiReader(&header, reader))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+			"\"image\" must be a PNG or JPEG", err)
+	} else if err != nil {
+		return nil, "", newAPIError(http.StatusUnprocessableEntity, codeUnprocessable,
+			fmt.Sprintf("\"image\" could not be decoded as a %s", format), err)
 	}
 
 	// Defense in depth - we never expect to have parse anything other than a PNG
 	// or a JPEG so error accordingly if expectations differ from reality.
 	if format != "png" && format != "jpeg" {
-		return nil, fmt.Errorf(
-			"decoded with unsupported format: %q", err.Error())
+		return nil, "", newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+			fmt.Sprintf("decoded with unsupported format: %q", format), nil)
 	}
 
-	return &img, nil
+	return &img, format, nil
 }
 
 // toRGBA converts an image.Image to an image.RGBA
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// pngChunk encodes one PNG chunk
+func pngChunk(typ string, data []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	return buf.Bytes()
+}
+
+// hugePNG returns a few bytes claiming to be a width x height PNG
+func hugePNG(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 6 // 8 bit RGBA
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = append(out, pngChunk("IHDR", ihdr)...)
+	return append(out, pngChunk("IEND", nil)...)
+}
+
+func TestParseReaderToImageMaxPixels(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := parseReaderToImage(bytes.NewReader(small.Bytes()), 40*30)
+	if err != nil {
+		t.Fatalf("decoding a 40x30 PNG with a budget of 1200 pixels failed: %s", err)
+	}
+	if format != "png" || (*img).Bounds().Dx() != 40 || (*img).Bounds().Dy() != 30 {
+		t.Errorf("decoded a %s %v, want a 40x30 png", format, (*img).Bounds())
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"one pixel over", small.Bytes()},
+		{"decompression bomb", hugePNG(60000, 60000)},
+	} {
+		_, _, err := parseReaderToImage(bytes.NewReader(tt.data), 40*30-1)
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: got error %v, want a 413 apiError", tt.name, err)
+		}
+	}
+}
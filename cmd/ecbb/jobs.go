@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The statuses a job can have. Jobs start out queued and end up succeeded,
+// failed or cancelled.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// stageProgress is the rough fraction of a job that's done when each stage of
+// encryptImage starts. PNG encoding of noisy ECB output is the slow part.
+var stageProgress = map[string]float64{
+	stageDecoding:   0.1,
+	stageResizing:   0.2,
+	stageEncrypting: 0.3,
+	stageEncoding:   0.5,
+}
+
+// job is an asynchronous encryption submitted to `/v1/jobs`
+type job struct {
+	id string
+	// requestID is the ID of the request that submitted the job
+	requestID string
+	// owner is the name of the API key that submitted the job, if any. Only
+	// the same key can see or cancel it.
+	owner       string
+	callbackURL string
+	parameters  encryptParameters
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// The fields below are guarded by the jobRunner's mutex
+
+	// input holds the image and key until the job starts running
+	input    encryptInput
+	status   string
+	stage    string
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	result   *encryptResult
+	err      *apiError
+	// size is how much of the jobRunner's byte budget the job's input or
+	// result is using
+	size int64
+}
+
+// done returns true if the job has finished, one way or another
+func (j *job) done() bool {
+	return j.status == jobSucceeded || j.status == jobFailed || j.status == jobCanceled
+}
+
+// jobError is the error reported for a failed job, or a failed file in a
+// batch
+type jobError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// jobView is the JSON representation of a job
+type jobView struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Stage      string            `json:"stage,omitempty"`
+	Progress   float64           `json:"progress"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+	Parameters encryptParameters `json:"parameters"`
+	Stats      *encryptStats     `json:"stats,omitempty"`
+	Error      *jobError         `json:"error,omitempty"`
+	ResultURL  string            `json:"resultURL,omitempty"`
+}
+
+// view returns the JSON representation of the job. The caller must hold the
+// jobRunner's mutex.
+func (j *job) view(ttl time.Duration) jobView {
+	v := jobView{
+		ID:         j.id,
+		Status:     j.status,
+		Stage:      j.stage,
+		Progress:   stageProgress[j.stage],
+		CreatedAt:  j.created,
+		Parameters: j.parameters,
+	}
+	if !j.started.IsZero() {
+		started := j.started
+		v.StartedAt = &started
+	}
+	if j.done() {
+		finished, expires := j.finished, j.finished.Add(ttl)
+		v.FinishedAt, v.ExpiresAt = &finished, &expires
+	}
+	switch j.status {
+	case jobSucceeded:
+		stats := j.result.jsonStats()
+		v.Progress = 1
+		v.Stats = &stats
+		v.ResultURL = "/v1/jobs/" + j.id + "/result"
+	case jobFailed:
+		v.Error = &jobError{Code: j.err.code, Message: j.err.message}
+	}
+	return v
+}
+
+// jobRunner runs jobs on a fixed number of worker goroutines and keeps them
+// around until they expire
+type jobRunner struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	queue chan *job
+	// ttl is how long finished jobs are kept
+	ttl time.Duration
+	// maxBytes is the budget for the inputs of queued jobs and the results
+	// of finished ones, and bytes is how much of it is used
+	maxBytes       int64
+	bytes          int64
+	log            *slog.Logger
+	callbackClient *http.Client
+	// admission is shared with the HTTP handlers so that jobs and requests
+	// together don't run more than `MaxConcurrent` encryptions at once
+	admission *admission
+	// cache is shared with the HTTP handlers too
+	cache *resultCache
+	// closed is set by shutdown, after which no more jobs are accepted
+	closed bool
+	// workers and callbacks track the goroutines shutdown waits for
+	workers   sync.WaitGroup
+	callbacks sync.WaitGroup
+}
+
+// newJobRunner creates a jobRunner using the job settings from cfg and starts
+// its workers
+func newJobRunner(cfg config, log *slog.Logger, admission *admission, cache *resultCache) *jobRunner {
+	jr := &jobRunner{
+		jobs:           make(map[string]*job),
+		queue:          make(chan *job, cfg.JobQueueSize),
+		ttl:            cfg.JobTTL,
+		maxBytes:       cfg.JobResultBytes,
+		log:            log,
+		callbackClient: newCallbackClient(cfg),
+		admission:      admission,
+		cache:          cache,
+	}
+	jr.workers.Add(cfg.JobWorkers)
+	for i := 0; i < cfg.JobWorkers; i++ {
+		go jr.work()
+	}
+	go jr.reap()
+	return jr
+}
+
+// newCallbackClient creates the client job callbacks are POSTed with. Clients
+// pick the callback URL, so like `imageURL` fetches it's kept away from the
+// server and its network, doesn't use a proxy and doesn't follow redirects.
+func newCallbackClient(cfg config) *http.Client {
+	dialer := guardedDialer(cfg.JobCallbackTimeout, cfg.JobCallbackAllowPrivate)
+	return &http.Client{
+		Timeout: cfg.JobCallbackTimeout,
+		Transport: &http.Transport{
+			Proxy:                  nil,
+			DialContext:            dialer.DialContext,
+			TLSHandshakeTimeout:    cfg.JobCallbackTimeout,
+			ResponseHeaderTimeout:  cfg.JobCallbackTimeout,
+			MaxResponseHeaderBytes: 64 << 10,
+			MaxIdleConns:           16,
+			IdleConnTimeout:        time.Minute,
+		},
+		// A redirect is logged as a failed callback
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// newJobID returns a random job ID. Job IDs are the only thing protecting a
+// job's result so they're longer than request IDs.
+func newJobID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// submit queues a job to be run. If the queue is full, the jobs being kept
+// have used up the byte budget, or the server is shutting down, a 503
+// apiError is returned.
+func (jr *jobRunner) submit(j *job) (jobView, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if jr.closed {
+		j.cancel()
+		return jobView{}, newAPIError(http.StatusServiceUnavailable, codeUnavailable,
+			"the server is shutting down, try again later", nil)
+	}
+	size := int64(len(j.input.image))
+	if jr.bytes+size > jr.maxBytes {
+		jr.forgetExpired()
+	}
+	if jr.bytes+size > jr.maxBytes {
+		j.cancel()
+		return jobView{}, newAPIError(http.StatusServiceUnavailable, codeUnavailable,
+			"too many job results are being kept, try again later", nil)
+	}
+	select {
+	case jr.queue <- j:
+	default:
+		j.cancel()
+		return jobView{}, newAPIError(http.StatusServiceUnavailable, codeUnavailable,
+			"the job queue is full, try again later", nil)
+	}
+	jr.jobs[j.id] = j
+	jr.resize(j, size)
+	return j.view(jr.ttl), nil
+}
+
+// resize changes how much of the byte budget a job is using. The caller must
+// hold the mutex.
+func (jr *jobRunner) resize(j *job, size int64) {
+	jr.bytes += size - j.size
+	j.size = size
+}
+
+// lookup returns the job with the given ID belonging to owner. Expired jobs
+// and other owners' jobs are treated as missing. The caller must hold the
+// mutex.
+func (jr *jobRunner) lookup(id, owner string) (*job, error) {
+	j, ok := jr.jobs[id]
+	if !ok || j.owner != owner || (j.done() && time.Since(j.finished) > jr.ttl) {
+		return nil, newAPIError(http.StatusNotFound, codeNotFound,
+			"no job with ID \""+id+"\" (it may have expired)", nil)
+	}
+	return j, nil
+}
+
+// get returns the JSON representation of a job
+func (jr *jobRunner) get(id, owner string) (jobView, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	j, err := jr.lookup(id, owner)
+	if err != nil {
+		return jobView{}, err
+	}
+	return j.view(jr.ttl), nil
+}
+
+// result returns the PNG result of a job. It's a 409 apiError if the job
+// hasn't succeeded (yet).
+func (jr *jobRunner) result(id, owner string) ([]byte, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	j, err := jr.lookup(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	if j.status != jobSucceeded {
+		return nil, newAPIError(http.StatusConflict, codeNotReady,
+			"job \""+id+"\" has no result, its status is "+j.status, nil)
+	}
+	return j.result.png, nil
+}
+
+// cancel cancels a job. A queued job is cancelled straight away, a running
+// job is stopped as soon as it finishes its current stage. Cancelling a job
+// that has already finished does nothing.
+func (jr *jobRunner) cancel(id, owner string) (jobView, error) {
+	jr.mu.Lock()
+	j, err := jr.lookup(id, owner)
+	if err != nil {
+		jr.mu.Unlock()
+		return jobView{}, err
+	}
+	wasQueued := j.status == jobQueued
+	if !j.done() {
+		j.cancel()
+		j.status = jobCanceled
+		j.finished = time.Now()
+		j.input = encryptInput{}
+		jr.resize(j, 0)
+	}
+	v := j.view(jr.ttl)
+	jr.mu.Unlock()
+
+	// A running job is finished off (and its callback notified) by its worker
+	if wasQueued {
+		jr.finish(j, v)
+	}
+	return v, nil
+}
+
+// work runs queued jobs until the queue is closed
+func (jr *jobRunner) work() {
+	defer jr.workers.Done()
+	for j := range jr.queue {
+		jr.run(j)
+	}
+}
+
+// run encrypts a job's input and records the outcome
+func (jr *jobRunner) run(j *job) {
+	if err := jr.admission.wait(j.ctx); err != nil {
+		// Cancelled while it was waiting, cancel() recorded it
+		return
+	}
+	defer jr.admission.release()
+
+	jr.mu.Lock()
+	if j.status != jobQueued {
+		// Cancelled while it was waiting
+		jr.mu.Unlock()
+		return
+	}
+	j.status = jobRunning
+	j.started = time.Now()
+	in := j.input
+	j.input = encryptInput{}
+	jr.mu.Unlock()
+
+	result, _, err := jr.cache.encrypt(j.ctx, in, func(stage string) {
+		jr.mu.Lock()
+		j.stage = stage
+		jr.mu.Unlock()
+	})
+
+	jr.mu.Lock()
+	switch {
+	case j.status == jobCanceled:
+		// cancel() already recorded it
+	case err != nil:
+		j.status = jobFailed
+		j.finished = time.Now()
+		if !errors.As(err, &j.err) {
+			j.err = internalError(err)
+		}
+		jr.resize(j, 0)
+	default:
+		j.status = jobSucceeded
+		j.finished = time.Now()
+		j.result = result
+		jr.resize(j, int64(len(result.png)))
+	}
+	j.cancel()
+	v := j.view(jr.ttl)
+	jr.mu.Unlock()
+
+	jr.finish(j, v)
+}
+
+// finish logs a job that has just finished and notifies its callback URL
+func (jr *jobRunner) finish(j *job, v jobView) {
+	attrs := []slog.Attr{
+		slog.String("job_id", j.id),
+		slog.String("request_id", j.requestID),
+		slog.String("status", v.Status),
+		slog.Duration("duration", v.FinishedAt.Sub(v.CreatedAt)),
+	}
+	level := slog.LevelInfo
+	if v.Status == jobFailed {
+		attrs = append(attrs, slog.String("error", j.err.Error()))
+		if j.err.status >= 500 {
+			level = slog.LevelError
+		}
+	}
+	jr.log.LogAttrs(context.Background(), level, "job", attrs...)
+
+	if j.callbackURL != "" {
+		jr.callbacks.Add(1)
+		go func() {
+			defer jr.callbacks.Done()
+			jr.notify(j.callbackURL, v)
+		}()
+	}
+}
+
+// notify POSTs a finished job's JSON representation to its callback URL. The
+// callback is only tried once.
+func (jr *jobRunner) notify(callbackURL string, v jobView) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		jr.log.Error("encoding job callback", "job_id", v.ID, "error", err)
+		return
+	}
+	resp, err := jr.callbackClient.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		jr.log.Warn("job callback failed", "job_id", v.ID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		jr.log.Warn("job callback failed", "job_id", v.ID, "status", resp.StatusCode)
+	}
+}
+
+// shutdown stops accepting jobs and waits for the queued and running jobs,
+// and their callbacks, to finish. If ctx is done first every unfinished job is
+// cancelled and shutdown returns without waiting for them. It returns the
+// number of jobs that were cancelled.
+func (jr *jobRunner) shutdown(ctx context.Context) int {
+	jr.mu.Lock()
+	jr.closed = true
+	close(jr.queue)
+	jr.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		jr.workers.Wait()
+		jr.callbacks.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return 0
+	case <-ctx.Done():
+	}
+
+	jr.mu.Lock()
+	canceled := 0
+	var queued []*job
+	var views []jobView
+	for _, j := range jr.jobs {
+		if j.done() {
+			continue
+		}
+		if j.status == jobQueued {
+			queued = append(queued, j)
+		}
+		j.cancel()
+		j.status = jobCanceled
+		j.finished = time.Now()
+		j.input = encryptInput{}
+		jr.resize(j, 0)
+		canceled++
+	}
+	for _, j := range queued {
+		views = append(views, j.view(jr.ttl))
+	}
+	jr.mu.Unlock()
+
+	// Like cancel(), running jobs are finished off by their workers
+	for i, j := range queued {
+		jr.finish(j, views[i])
+	}
+	return canceled
+}
+
+// reap periodically forgets jobs that have expired
+func (jr *jobRunner) reap() {
+	interval := jr.ttl
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		jr.mu.Lock()
+		jr.forgetExpired()
+		jr.mu.Unlock()
+	}
+}
+
+// forgetExpired forgets jobs that have expired, freeing their part of the
+// byte budget. The caller must hold the mutex.
+func (jr *jobRunner) forgetExpired() {
+	for id, j := range jr.jobs {
+		if j.done() && time.Since(j.finished) > jr.ttl {
+			jr.resize(j, 0)
+			delete(jr.jobs, id)
+		}
+	}
+}
+
+// jobRequest is the JSON body accepted by `/v1/jobs`. It's an encryptRequest
+// with an optional URL to POST the finished job to.
+type jobRequest struct {
+	encryptRequest
+	CallbackURL string `json:"callbackURL"`
+}
+
+// checkCallbackURL returns a 400 apiError if a job callback URL isn't an
+// absolute http or https URL, or, unless allowPrivate is set, its host is a
+// blocked IP address. Hostnames are checked when the callback connects.
+func checkCallbackURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"callbackURL\" must be an absolute http or https URL", err)
+	}
+	if u.User != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"callbackURL\" must not have a username or password", nil)
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !allowPrivate && blockedAddr(addr) {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"callbackURL\" is an address that is not allowed", nil)
+	}
+	return nil
+}
+
+// jobOwner returns the owner of jobs submitted by a request: the name of its
+// API key, or "" if API keys aren't being used
+func jobOwner(r *http.Request) string {
+	if key := requestAPIKey(r); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// submitJob is an HTTP handler that queues an encryption job sent as JSON. It
+// returns the new job straight away with a 202.
+func (s *server) submitJob(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
+		return
+	}
+
+	var req jobRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if req.Store {
+		s.writeError(w, r, newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"\"store\" can't be used with jobs, their results are already kept for a while", nil))
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := checkCallbackURL(req.CallbackURL, s.config().JobCallbackAllowPrivate); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+	in, err := s.prepareEncrypt(r, req.encryptRequest)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// The job outlives the request so it can't use the request's context
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:          newJobID(),
+		requestID:   requestID(r),
+		owner:       jobOwner(r),
+		callbackURL: req.CallbackURL,
+		parameters:  in.parameters(),
+		ctx:         ctx,
+		cancel:      cancel,
+		input:       in,
+		status:      jobQueued,
+		created:     time.Now(),
+	}
+	v, err := s.jobs.submit(j)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	addLogAttrs(r, slog.String("job_id", j.id))
+
+	w.Header().Set("Location", "/v1/jobs/"+j.id)
+	s.writeJSON(w, r, http.StatusAccepted, v)
+}
+
+// jobStatus is an HTTP handler that returns a job's status, or cancels it
+// when the method is DELETE
+func (s *server) jobStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	id := r.PathValue("id")
+	addLogAttrs(r, slog.String("job_id", id))
+	var v jobView
+	var err error
+	if r.Method == http.MethodDelete {
+		v, err = s.jobs.cancel(id, jobOwner(r))
+	} else {
+		v, err = s.jobs.get(id, jobOwner(r))
+	}
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, v)
+}
+
+// jobResult is an HTTP handler that returns the PNG result of a succeeded job
+func (s *server) jobResult(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	id := r.PathValue("id")
+	addLogAttrs(r, slog.String("job_id", id))
+	result, err := s.jobs.result(id, jobOwner(r))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(result)
+}
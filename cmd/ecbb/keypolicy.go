@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// requestKey returns the encryption key for a request. If the `key` form value
+// is empty the configured default key is used, unless the key policy requires
+// callers to bring their own. An error is returned if the key violates the
+// key policy.
+func (s *server) requestKey(r *http.Request) (string, error) {
+	key, _, err := s.resolveKey(r.FormValue("key"))
+	return key, err
+}
+
+// resolveKey applies the key policy to a caller provided key, returning the
+// key to encrypt with and whether it's the default key
+func (s *server) resolveKey(key string) (string, bool, error) {
+	if key == "" {
+		if s.config().RequireKey {
+			return "", false, newAPIError(http.StatusBadRequest, codeInvalidKey,
+				"a non-empty \"key\" is required", nil)
+		}
+		// The default key is trusted, it doesn't need to pass the policy
+		return s.config().DefaultKey, true, nil
+	}
+	if err := s.checkKey(key); err != nil {
+		return "", false, err
+	}
+	return key, false, nil
+}
+
+// checkKey returns an error if a caller provided key violates the configured
+// minimum/maximum length or is on the banned key list
+func (s *server) checkKey(key string) error {
+	length := utf8.RuneCountInString(key)
+	if min := s.config().MinKeyLength; min > 0 && length < min {
+		return newAPIError(http.StatusBadRequest, codeInvalidKey,
+			fmt.Sprintf("\"key\" must be at least %d characters long", min), nil)
+	}
+	if max := s.config().MaxKeyLength; max > 0 && length > max {
+		return newAPIError(http.StatusBadRequest, codeInvalidKey,
+			fmt.Sprintf("\"key\" must be at most %d characters long", max), nil)
+	}
+	for _, banned := range s.config().BannedKeys {
+		if strings.EqualFold(key, banned) {
+			return newAPIError(http.StatusBadRequest, codeInvalidKey,
+				"\"key\" is not allowed, pick another one", nil)
+		}
+	}
+	return nil
+}
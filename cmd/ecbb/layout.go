@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+)
+
+// pixelLayout describes how an image's pixels are arranged into bytes before
+// they're ECB encrypted. The layout changes which bytes end up sharing a block
+// and so changes what ECB leaks. An image is split into one or more byte
+// planes, some (or all) of the planes are encrypted, and then the planes are
+// joined back together into an image.
+type pixelLayout struct {
+	name string
+	// planes splits an image into byte planes
+	planes func(rgba *image.RGBA) [][]byte
+	// encrypted lists the indexes of the planes that are encrypted. The other
+	// planes are left alone.
+	encrypted []int
+	// join builds an image from its planes
+	join func(bounds image.Rectangle, planes [][]byte) image.Image
+}
+
+var (
+	// interleavedLayout encrypts the RGBA bytes as they are in memory. Every
+	// 16 byte block holds 4 whole pixels, mixing the channels together.
+	interleavedLayout = pixelLayout{
+		name: "interleaved",
+		planes: func(rgba *image.RGBA) [][]byte {
+			return [][]byte{rgba.Pix}
+		},
+		encrypted: []int{0},
+		join: func(bounds image.Rectangle, planes [][]byte) image.Image {
+			// Everything is an ECB Penguin if you squint hard enough
+			penguin := image.NewRGBA(bounds)
+			penguin.Pix = planes[0]
+			return penguin
+		},
+	}
+	// planarLayout splits the image into separate R, G and B planes and
+	// encrypts each plane on its own, so every block holds 16 values of a single
+	// channel
+	planarLayout = pixelLayout{
+		name: "planar",
+		planes: func(rgba *image.RGBA) [][]byte {
+			r, g, b := rgbPlanes(rgba)
+			return [][]byte{r, g, b}
+		},
+		encrypted: []int{0, 1, 2},
+		join: func(bounds image.Rectangle, planes [][]byte) image.Image {
+			return fromRGBPlanes(bounds, planes[0], planes[1], planes[2])
+		},
+	}
+	// lumaLayout converts the image to YCbCr and encrypts only the Y (brightness)
+	// plane, leaving the colour untouched
+	lumaLayout = pixelLayout{
+		name:      "luma",
+		planes:    yCbCrPlaneList,
+		encrypted: []int{0},
+		join:      joinYCbCrPlanes,
+	}
+	// chromaLayout converts the image to YCbCr and encrypts only the Cb and Cr
+	// (colour) planes, leaving the brightness untouched
+	chromaLayout = pixelLayout{
+		name:      "chroma",
+		planes:    yCbCrPlaneList,
+		encrypted: []int{1, 2},
+		join:      joinYCbCrPlanes,
+	}
+
+	// pixelLayouts maps the names accepted by the API to layouts
+	pixelLayouts = map[string]pixelLayout{
+		interleavedLayout.name: interleavedLayout,
+		planarLayout.name:      planarLayout,
+		lumaLayout.name:        lumaLayout,
+		chromaLayout.name:      chromaLayout,
+	}
+)
+
+// parseLayout reads the optional `layout` form value from a request. When it
+// isn't given the original interleaved RGBA layout is used.
+func parseLayout(r *http.Request) (pixelLayout, error) {
+	return lookupLayout(r.FormValue("layout"))
+}
+
+// lookupLayout returns the pixel layout with the given name. An empty name is
+// the original interleaved RGBA layout.
+func lookupLayout(name string) (pixelLayout, error) {
+	if name == "" {
+		return interleavedLayout, nil
+	}
+	layout, ok := pixelLayouts[name]
+	if !ok {
+		return interleavedLayout, fmt.Errorf("unknown \"layout\" %q", name)
+	}
+	return layout, nil
+}
+
+// encrypt ECB encrypts rgba with the given key using the layout. Each of the
+// layout's encrypted planes is encrypted separately and truncated back to its
+// original length. Stats about the ciphertext blocks are also returned.
+func (l pixelLayout) encrypt(rgba *image.RGBA, key string) (image.Image, blockStats, error) {
+	planes := l.planes(rgba)
+	var ciphertexts [][]byte
+	for _, i := range l.encrypted {
+		ciphertext, err := ecbEncryptBytes(planes[i], key)
+		if err != nil {
+			return nil, blockStats{}, err
+		}
+		planes[i] = ciphertext[:len(planes[i])]
+		ciphertexts = append(ciphertexts, planes[i])
+	}
+	return l.join(rgba.Bounds(), planes), countBlocks(ciphertexts), nil
+}
+
+// rgbPlanes splits an RGBA image into row-major R, G and B planes. Alpha is
+// dropped.
+func rgbPlanes(rgba *image.RGBA) (r, g, b []byte) {
+	bounds := rgba.Bounds()
+	n := bounds.Dx() * bounds.Dy()
+	r, g, b = make([]byte, 0, n), make([]byte, 0, n), make([]byte, 0, n)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := rgba.RGBAAt(x, y)
+			r, g, b = append(r, c.R), append(g, c.G), append(b, c.B)
+		}
+	}
+	return r, g, b
+}
+
+// fromRGBPlanes builds an opaque RGBA image from row-major R, G and B planes
+func fromRGBPlanes(bounds image.Rectangle, r, g, b []byte) *image.RGBA {
+	out := image.NewRGBA(bounds)
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			out.SetRGBA(x, y, color.RGBA{r[i], g[i], b[i], 0xff})
+			i++
+		}
+	}
+	return out
+}
+
+// yCbCrPlanes converts an RGBA image into row-major Y, Cb and Cr planes
+func yCbCrPlanes(rgba *image.RGBA) (yp, cb, cr []byte) {
+	r, g, b := rgbPlanes(rgba)
+	yp, cb, cr = make([]byte, len(r)), make([]byte, len(r)), make([]byte, len(r))
+	for i := range r {
+		yp[i], cb[i], cr[i] = color.RGBToYCbCr(r[i], g[i], b[i])
+	}
+	return yp, cb, cr
+}
+
+// yCbCrPlaneList returns the Y, Cb and Cr planes of an RGBA image as a list
+func yCbCrPlaneList(rgba *image.RGBA) [][]byte {
+	y, cb, cr := yCbCrPlanes(rgba)
+	return [][]byte{y, cb, cr}
+}
+
+// joinYCbCrPlanes builds an image from a list of Y, Cb and Cr planes
+func joinYCbCrPlanes(bounds image.Rectangle, planes [][]byte) image.Image {
+	return fromYCbCrPlanes(bounds, planes[0], planes[1], planes[2])
+}
+
+// fromYCbCrPlanes builds an opaque RGBA image from row-major Y, Cb and Cr
+// planes
+func fromYCbCrPlanes(bounds image.Rectangle, yp, cb, cr []byte) *image.RGBA {
+	r, g, b := make([]byte, len(yp)), make([]byte, len(yp)), make([]byte, len(yp))
+	for i := range yp {
+		r[i], g[i], b[i] = color.YCbCrToRGB(yp[i], cb[i], cr[i])
+	}
+	return fromRGBPlanes(bounds, r, g, b)
+}
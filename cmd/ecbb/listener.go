@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixListenPrefix marks a `listen` address as a unix domain socket path
+const unixListenPrefix = "unix:"
+
+// systemdListenFDsStart is the first file descriptor systemd passes sockets
+// on, see sd_listen_fds(3)
+const systemdListenFDsStart = 3
+
+// parseSocketMode parses `listenSocketMode`, an octal file mode like "0660"
+func parseSocketMode(raw string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("must be an octal file mode like 0660, got %q", raw)
+	}
+	return os.FileMode(mode), nil
+}
+
+// systemdListener returns the socket systemd passed us for socket activation,
+// or nil if we weren't socket activated. Only one socket is supported. The
+// `LISTEN_*` variables are unset so they aren't inherited by anything we run.
+func systemdListener() (net.Listener, error) {
+	rawPID, rawFDs := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if rawFDs == "" {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	// The sockets were meant for someone else, e.g. a parent process that
+	// didn't unset the variables
+	if pid, err := strconv.Atoi(rawPID); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(rawFDs)
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS must be a positive number, got %q", rawFDs)
+	}
+	if fds > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, only one is supported", fds)
+	}
+
+	name := "LISTEN_FD_" + strconv.Itoa(systemdListenFDsStart)
+	if names := os.Getenv("LISTEN_FDNAMES"); names != "" {
+		name = strings.Split(names, ":")[0]
+	}
+	f := os.NewFile(uintptr(systemdListenFDsStart), name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using the socket systemd passed: %s", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a unix domain socket at path with the given file
+// mode. A socket left behind by a server that didn't shut down cleanly is
+// replaced, but anything else at path is an error.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q already exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%q is already being listened on", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// The socket is removed again when the listener is closed
+	return listenUnixMode(path, mode)
+}
+
+// listener returns the listener the server should accept connections on: the
+// socket from systemd socket activation if there is one, otherwise the
+// `listen` address, which is a TCP address or `unix:` and a socket path
+func (s *server) listener() (net.Listener, error) {
+	ln, err := systemdListener()
+	if err != nil || ln != nil {
+		if ln != nil {
+			s.log.Info("using the socket passed by systemd, ignoring listen",
+				"addr", ln.Addr().String())
+		}
+		return ln, err
+	}
+
+	if path, ok := strings.CutPrefix(s.config().Listen, unixListenPrefix); ok {
+		// The mode was already checked by config.validate()
+		mode, _ := parseSocketMode(s.config().ListenSocketMode)
+		return listenUnix(path, mode)
+	}
+	return net.Listen("tcp", s.config().Listen)
+}
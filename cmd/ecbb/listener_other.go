@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnixMode creates a unix domain socket at path and gives it the given
+// file mode. There's no umask to create it with the mode, and file modes mean
+// little to unix domain sockets outside of unix anyway.
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
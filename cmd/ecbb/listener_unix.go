@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnixMode creates a unix domain socket at path that has the given file
+// mode from the start. The umask is tightened while the socket is created, so
+// there's no moment when other users can connect to it. The umask is shared
+// by the whole process, which is fine since this only happens at startup.
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	old := syscall.Umask(int(0777 &^ mode.Perm()))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	path := filepath.Join(t.TempDir(), "ecbb.sock")
+	ln, err := listenUnix(path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("the socket's mode is %s, want a socket with 0660", info.Mode())
+	}
+	if umask := syscall.Umask(0); umask != 0 {
+		t.Errorf("the umask is %#o after listening, want it put back to 0", umask)
+	}
+}
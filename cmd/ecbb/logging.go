@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// contextKey is the type used for values the server stores in a request
+// context
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestLogKey
+	authKey
+)
+
+// requestLog collects attributes about a request while it's being handled.
+// They're written out as part of a single log line once the request is done.
+type requestLog struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+	// route is the pattern the request matched, used to label its metrics
+	route string
+}
+
+// newLogger creates a JSON logger writing to w that drops messages below the
+// configured `LogLevel`
+func newLogger(cfg config, w io.Writer) *slog.Logger {
+	var level slog.Level
+	// The level was already checked by config.validate()
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// newRequestID returns a random identifier for a request
+func newRequestID() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// requestID returns the ID assigned to a request by `logRequests`
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// addLogAttrs attaches attributes to the log line that will be written for the
+// request once it's done
+func addLogAttrs(r *http.Request, attrs ...slog.Attr) {
+	addContextLogAttrs(r.Context(), attrs...)
+}
+
+// addContextLogAttrs is addLogAttrs for code that only has the request's
+// context. It does nothing if the context doesn't belong to a request.
+func addContextLogAttrs(ctx context.Context, attrs ...slog.Attr) {
+	l, ok := ctx.Value(requestLogKey).(*requestLog)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attrs = append(l.attrs, attrs...)
+}
+
+// recordRoute is middleware that notes which of mux's patterns a request
+// matches before passing it to next, so its metrics can be labelled by route
+// rather than by path. With nested muxes the innermost match wins.
+func recordRoute(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l, ok := r.Context().Value(requestLogKey).(*requestLog); ok {
+			_, pattern := mux.Handler(r)
+			l.mu.Lock()
+			l.route = pattern
+			l.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequestError attaches an error message to the log line that will be
+// written for the request
+func logRequestError(r *http.Request, msg string) {
+	addLogAttrs(r, slog.String("error", msg))
+}
+
+// logKey attaches a salted fingerprint of key to the log line for the request
+// if `LogKeyFingerprints` is enabled. The key itself is never logged. The
+// fingerprint lets us spot the same key being used again without being able
+// to recover it (unless it's easily guessed, so it's off by default).
+func (s *server) logKey(r *http.Request, key string) {
+	if !s.config().LogKeyFingerprints {
+		return
+	}
+	mac := hmac.New(sha256.New, s.fingerprintSalt)
+	mac.Write([]byte(key))
+	addLogAttrs(r, slog.String("key_fingerprint", hex.EncodeToString(mac.Sum(nil)[:8])))
+}
+
+// statusRecorder is a http.ResponseWriter that remembers the status code and
+// the number of bytes written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// logRequests is middleware that assigns every request an ID (returned in the
+// `X-Request-ID` header) and writes one structured log line per request once
+// it has been handled. Server errors are logged at the error level, client
+// errors at the warn level and everything else at the info level. The
+// request's metrics are recorded at the same time.
+func (s *server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := newRequestID()
+		l := &requestLog{}
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, requestLogKey, l)
+		r = r.WithContext(ctx)
+
+		w.Header().Set("X-Request-ID", id)
+		rec := &statusRecorder{ResponseWriter: w}
+		httpInFlight.add(1)
+		// Deferred so a panicking handler doesn't leave the gauge too high
+		defer httpInFlight.add(-1)
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes_in", r.ContentLength),
+			slog.Int64("bytes_out", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			attrs = append(attrs, slog.String("client_cert", r.TLS.PeerCertificates[0].Subject.String()))
+		}
+		l.mu.Lock()
+		attrs = append(attrs, l.attrs...)
+		route := l.route
+		l.mu.Unlock()
+		observeRequest(route, r.Method, rec.status, r.ContentLength, rec.bytes, start)
+		s.log.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"flag"
 	"fmt"
-	"net/http"
+	"os"
+
+	"github.com/cpu/ecbb/util"
 )
 
 const greetz = `
@@ -23,13 +24,41 @@ Bzztt. Greetings HUMAN. I am
     At your service
 `
 
-// main starts a HTTP server on the provided -listen address
+// main starts a HTTP server on the configured -listen address (or the socket
+// systemd passed us) and runs it until it's told to shut down
 func main() {
-	listenArg := flag.String("listen", "localhost:6969", "Bind address/port for HTTP server")
 	fmt.Printf("%s\n", greetz)
-	flag.Parse()
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		util.ErrorQuit(err.Error())
+	}
 
-	// TODO(@cpu): Set some timeouts/limits for the HTTP server
-	http.HandleFunc("/new", newECB)
-	http.ListenAndServe(*listenArg, nil)
+	s, err := newServer(cfg)
+	if err != nil {
+		util.ErrorQuit(err.Error())
+	}
+	s.reloadAPIKeysOnSIGHUP()
+	srv := s.httpServer()
+	if cfg.tlsEnabled() {
+		srv.TLSConfig, err = s.tlsConfig()
+		if err != nil {
+			util.ErrorQuit(err.Error())
+		}
+	}
+	ln, err := s.listener()
+	if err != nil {
+		util.ErrorQuit(fmt.Sprintf("listening on %q: %s", cfg.Listen, err))
+	}
+	addr := ln.Addr()
+	if cfg.tlsEnabled() {
+		s.log.Info("listening", "addr", addr.String(), "network", addr.Network(),
+			"tls", true, "mutual_tls", cfg.TLSClientCA != "")
+		err = s.run(srv, func() error { return srv.ServeTLS(ln, "", "") })
+	} else {
+		s.log.Info("listening", "addr", addr.String(), "network", addr.Network(), "tls", false)
+		err = s.run(srv, func() error { return srv.Serve(ln) })
+	}
+	if err != nil {
+		util.ErrorQuit(err.Error())
+	}
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file has a tiny in-tree implementation of the Prometheus text
+// exposition format, just enough for counters, gauges and histograms with
+// labels. See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	// latencyBuckets are histogram buckets (in seconds) for request and stage
+	// durations
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	// pixelBuckets are histogram buckets for input image sizes, from a
+	// thumbnail up to a 100 megapixel monster
+	pixelBuckets = []float64{1e4, 1e5, 5e5, 1e6, 2e6, 5e6, 1e7, 2.5e7, 5e7, 1e8}
+)
+
+// The server's metrics. They're package level, like the image decoders, since
+// there's only ever one server in the process.
+var (
+	httpRequests = newCounterVec("ecbb_http_requests_total",
+		"HTTP requests handled, by route, method and status code", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("ecbb_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route", latencyBuckets, "route")
+	httpRequestBytes = newCounterVec("ecbb_http_request_bytes_total",
+		"Bytes of HTTP request bodies received, by route", "route")
+	httpResponseBytes = newCounterVec("ecbb_http_response_bytes_total",
+		"Bytes of HTTP response bodies sent, by route", "route")
+	httpInFlight = newGauge("ecbb_http_requests_in_flight",
+		"HTTP requests being handled right now")
+	stageDuration = newHistogramVec("ecbb_stage_duration_seconds",
+		"Time taken by each stage of encrypting an image, file or WAV", latencyBuckets, "stage")
+	inputPixels = newHistogramVec("ecbb_input_pixels",
+		"Pixel counts of decoded input images", pixelBuckets)
+	cacheHits = newCounterVec("ecbb_cache_hits_total",
+		"Encryptions answered from the result cache")
+	cacheMisses = newCounterVec("ecbb_cache_misses_total",
+		"Encryptions not found in the result cache")
+	cacheEvictions = newCounterVec("ecbb_cache_evictions_total",
+		"Results evicted from the result cache to stay under its budget")
+
+	// metricFamilies lists every metric above, in the order they're written
+	metricFamilies = []metricFamily{
+		httpRequests,
+		httpRequestDuration,
+		httpRequestBytes,
+		httpResponseBytes,
+		httpInFlight,
+		stageDuration,
+		inputPixels,
+		cacheHits,
+		cacheMisses,
+		cacheEvictions,
+	}
+)
+
+// metricFamily is a named metric that can write itself out
+type metricFamily interface {
+	writeTo(w io.Writer)
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels formats label names and values for the exposition format, e.g.
+// `{route="/new",status="200"}`. extra is added at the end if it isn't empty.
+func formatLabels(names, values []string, extra string) string {
+	var parts []string
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		parts = append(parts, name+`="`+v+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatFloat formats a sample value for the exposition format
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeHeader writes the HELP and TYPE lines for a metric
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	// labelValues keeps the label values for each key in values
+	labelValues map[string][]string
+}
+
+// newCounterVec creates a counter with the given label names
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:        name,
+		help:        help,
+		labels:      labels,
+		values:      make(map[string]float64),
+		labelValues: make(map[string][]string),
+	}
+}
+
+// add adds v to the counter with the given label values
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.labelValues[key]; !ok {
+		c.labelValues[key] = labelValues
+	}
+	c.values[key] += v
+}
+
+// counterValue is the value of a counterVec for one set of label values
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// snapshot returns the counter's current values, sorted by label values
+func (c *counterVec) snapshot() []counterValue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([]counterValue, 0, len(c.values))
+	for _, key := range sortedKeys(c.labelValues) {
+		values = append(values, counterValue{c.labelValues[key], c.values[key]})
+	}
+	return values
+}
+
+// total returns the sum of the counter's values for every set of labels
+func (c *counterVec) total() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total float64
+	for _, v := range c.values {
+		total += v
+	}
+	return total
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		// A counter without labels always has a value, even if it's zero
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range sortedKeys(c.labelValues) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			formatLabels(c.labels, c.labelValues[key], ""), formatFloat(c.values[key]))
+	}
+}
+
+// gauge is a gauge without labels
+type gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+// newGauge creates a gauge
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+// add adds delta to the gauge
+func (g *gauge) add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+// load returns the gauge's current value
+func (g *gauge) load() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.load())
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are written
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (g gaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// histogram is one set of histogram buckets
+type histogram struct {
+	labelValues []string
+	// counts[i] is the number of observations <= buckets[i], the last count is
+	// everything (the +Inf bucket)
+	counts []uint64
+	sum    float64
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+// newHistogramVec creates a histogram with the given (sorted) bucket upper
+// bounds and label names
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// observe records v in the histogram with the given label values
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.counts[len(h.buckets)]++
+	hist.sum += v
+}
+
+// observeDuration records the time since start, in seconds
+func (h *histogramVec) observeDuration(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.histograms[key]
+		for i, count := range hist.counts {
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			le := `le="` + formatFloat(bound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, hist.labelValues, le), count)
+		}
+		labels := formatLabels(h.labels, hist.labelValues, "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.counts[len(h.buckets)])
+	}
+}
+
+// sortedKeys returns the keys of a map in order, so output is stable
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// knownMethods are the HTTP methods used as metric labels as-is. Anything
+// else is counted as "other" so clients can't create unlimited label values.
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodPatch:   true,
+}
+
+// observeRequest records the metrics for a finished HTTP request
+func observeRequest(route, method string, status int, bytesIn, bytesOut int64, start time.Time) {
+	if route == "" {
+		route = "unmatched"
+	}
+	if !knownMethods[method] {
+		method = "other"
+	}
+	httpRequests.add(1, route, method, strconv.Itoa(status))
+	httpRequestDuration.observeDuration(start, route)
+	if bytesIn > 0 {
+		httpRequestBytes.add(float64(bytesIn), route)
+	}
+	httpResponseBytes.add(float64(bytesOut), route)
+}
+
+// serverGauges returns gauges describing the server's current load
+func (s *server) serverGauges() []metricFamily {
+	gauges := []metricFamily{
+		gaugeFunc{"ecbb_encryptions_running", "Encryptions running right now, including jobs",
+			func() float64 { running, _ := s.admission.depth(); return float64(running) }},
+		gaugeFunc{"ecbb_encryptions_queued", "Requests waiting for a free encryption slot",
+			func() float64 { _, queued := s.admission.depth(); return float64(queued) }},
+		gaugeFunc{"ecbb_jobs_queued", "Jobs waiting for a worker",
+			func() float64 { return float64(len(s.jobs.queue)) }},
+		gaugeFunc{"ecbb_cache_entries", "Results in the result cache",
+			func() float64 { entries, _ := s.cache.stats(); return float64(entries) }},
+		gaugeFunc{"ecbb_cache_bytes", "Bytes used by the result cache",
+			func() float64 { _, used := s.cache.stats(); return float64(used) }},
+	}
+	if s.store != nil {
+		gauges = append(gauges,
+			gaugeFunc{"ecbb_stored_results", "Results saved for /r/{id}",
+				func() float64 { results, _ := s.store.usage(); return float64(results) }},
+			gaugeFunc{"ecbb_stored_bytes", "Bytes used by results saved for /r/{id}",
+				func() float64 { _, used := s.store.usage(); return float64(used) }})
+	}
+	return gauges
+}
+
+// metrics is an HTTP handler that writes every metric in the Prometheus text
+// exposition format
+func (s *server) metrics(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, m := range append(metricFamilies, s.serverGauges()...) {
+		m.writeTo(buf)
+	}
+	buf.Flush()
+}
+
+// healthz is an HTTP handler for liveness checks. If the server can answer at
+// all, it's alive.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+// readyz is an HTTP handler for readiness checks. The server isn't ready for
+// more traffic while it's shutting down or its encryption queue is full.
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "shutting down\n")
+		return
+	}
+	// Like currentLoad, the limit comes from the queue, which is sized when
+	// the server starts
+	if _, queued := s.admission.depth(); queued >= s.admission.maxQueued && s.admission.maxQueued > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "busy\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyzUsesTheQueueSize(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxConcurrent, cfg.MaxQueued = 1, 1
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.log = testLogger
+	// The config says more can queue, but the queue was sized at startup
+	cfg.MaxQueued = 10
+	s.cfg.Store(&cfg)
+
+	if err := s.admission.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.admission.release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.admission.acquire(ctx)
+	for _, queued := s.admission.depth(); queued < 1; _, queued = s.admission.depth() {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	s.readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with a full queue, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if load := s.currentLoad(); load.Queued < load.MaxQueued {
+		t.Errorf("the load report %+v doesn't show a full queue", load)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// blockCipherName describes the (deliberately bad) cipher every endpoint uses
+const blockCipherName = "AES-128-ECB"
+
+// encryptOptions are the output options for encrypting an image. They're
+// read from form values by `/new` and from the `options` object by
+// `/v1/encrypt`. A zero value for any option means the default.
+type encryptOptions struct {
+	MaxWidth  int    `json:"maxWidth"`
+	MaxHeight int    `json:"maxHeight"`
+	MaxBytes  int    `json:"maxBytes"`
+	Resample  string `json:"resample"`
+	Layout    string `json:"layout"`
+}
+
+// encryptParams are validated encryptOptions
+type encryptParams struct {
+	resize resizeOptions
+	layout pixelLayout
+	// maxPixels is the largest input image that will be decoded. It's the
+	// server's `maxPixels` setting rather than an option, so it isn't part of
+	// options().
+	maxPixels int64
+}
+
+// resolve validates the options and looks up the named filter and layout
+func (o encryptOptions) resolve() (encryptParams, error) {
+	resizeOpts, err := newResizeOptions(o.MaxWidth, o.MaxHeight, o.MaxBytes, o.Resample)
+	if err != nil {
+		return encryptParams{}, err
+	}
+	layout, err := lookupLayout(o.Layout)
+	if err != nil {
+		return encryptParams{}, err
+	}
+	return encryptParams{resize: resizeOpts, layout: layout}, nil
+}
+
+// options returns the effective options, with the default filter and layout
+// filled in
+func (p encryptParams) options() encryptOptions {
+	return encryptOptions{
+		MaxWidth:  p.resize.maxWidth,
+		MaxHeight: p.resize.maxHeight,
+		MaxBytes:  p.resize.maxBytes,
+		Resample:  p.resize.filter.name,
+		Layout:    p.layout.name,
+	}
+}
+
+// parseEncryptParams reads the encryption options from a request's form values
+func parseEncryptParams(r *http.Request) (encryptParams, error) {
+	resizeOpts, err := parseResizeOptions(r)
+	if err != nil {
+		return encryptParams{}, err
+	}
+	layout, err := parseLayout(r)
+	if err != nil {
+		return encryptParams{}, err
+	}
+	return encryptParams{resize: resizeOpts, layout: layout}, nil
+}
+
+// blockStats counts the full 16 byte ciphertext blocks in an encrypted image.
+// ECB encrypts equal plaintext blocks to equal ciphertext blocks so the
+// duplicate ratio is a rough measure of how much the result leaks.
+type blockStats struct {
+	Blocks          int     `json:"blocks"`
+	UniqueBlocks    int     `json:"uniqueBlocks"`
+	DuplicateBlocks int     `json:"duplicateBlocks"`
+	DuplicateRatio  float64 `json:"duplicateRatio"`
+}
+
+// countBlocks counts the unique and duplicate full blocks across all of the
+// given ciphertexts. A trailing partial block is ignored.
+func countBlocks(ciphertexts [][]byte) blockStats {
+	seen := make(map[[16]byte]struct{})
+	var stats blockStats
+	for _, c := range ciphertexts {
+		for off := 0; off+16 <= len(c); off += 16 {
+			var block [16]byte
+			copy(block[:], c[off:off+16])
+			seen[block] = struct{}{}
+			stats.Blocks++
+		}
+	}
+	stats.UniqueBlocks = len(seen)
+	stats.DuplicateBlocks = stats.Blocks - stats.UniqueBlocks
+	if stats.Blocks > 0 {
+		stats.DuplicateRatio = float64(stats.DuplicateBlocks) / float64(stats.Blocks)
+	}
+	return stats
+}
+
+// add adds other's block counts to stats and works out the ratio again.
+// UniqueBlocks is a sum too, blocks aren't compared across ciphertexts.
+func (stats *blockStats) add(other blockStats) {
+	stats.Blocks += other.Blocks
+	stats.UniqueBlocks += other.UniqueBlocks
+	stats.DuplicateBlocks += other.DuplicateBlocks
+	stats.DuplicateRatio = 0
+	if stats.Blocks > 0 {
+		stats.DuplicateRatio = float64(stats.DuplicateBlocks) / float64(stats.Blocks)
+	}
+}
+
+// encryptResult is a PNG encoded ECB encrypted image and what we know about
+// how it was made
+type encryptResult struct {
+	png                       []byte
+	inputFormat               string
+	inputWidth, inputHeight   int
+	outputWidth, outputHeight int
+	stats                     blockStats
+	// timings are how long each stage took to make the result
+	timings stageTimings
+}
+
+// The stages of encryptImage, in order, as reported to its progress function
+const (
+	stageDecoding   = "decoding"
+	stageResizing   = "resizing"
+	stageEncrypting = "encrypting"
+	stageEncoding   = "encoding"
+)
+
+// encryptImage decodes an image from reader, downscales it and ECB encrypts it
+// using the given params. If the context belongs to a request the input
+// format and dimensions are attached to its log line. progress (if not nil)
+// is called as each stage starts. encryptImage gives up with the context's
+// error if the context is cancelled between stages. The time taken by each
+// stage is recorded in the `ecbb_stage_duration_seconds` metric and the
+// result's timings.
+func encryptImage(ctx context.Context, reader io.Reader, key string, params encryptParams, progress func(stage string)) (*encryptResult, error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+
+	var timings stageTimings
+	progress(stageDecoding)
+	start := time.Now()
+	img, format, err := parseReaderToImage(reader, params.maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	timings.observe(start, "decode", "image.Decode")
+
+	bounds := (*img).Bounds()
+	addContextLogAttrs(ctx,
+		slog.String("format", format),
+		slog.Int("width", bounds.Dx()),
+		slog.Int("height", bounds.Dy()),
+		slog.String("layout", params.layout.name))
+	inputPixels.observe(float64(bounds.Dx()) * float64(bounds.Dy()))
+
+	result := &encryptResult{
+		inputFormat: format,
+		inputWidth:  bounds.Dx(),
+		inputHeight: bounds.Dy(),
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	progress(stageResizing)
+	start = time.Now()
+	rgba := toRGBA(*img)
+	timings.observe(start, "rgba", "toRGBA")
+	start = time.Now()
+	rgba = downscale(rgba, params.resize)
+	timings.observe(start, "resize", "downscale")
+	opts := params.resize
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(stageEncrypting)
+		start = time.Now()
+		ecbImage, stats, err := params.layout.encrypt(rgba, key)
+		if err != nil {
+			return nil, err
+		}
+		timings.observe(start, "encrypt", "ecbEncryptBytes")
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress(stageEncoding)
+		start = time.Now()
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, ecbImage); err != nil {
+			return nil, err
+		}
+		timings.observe(start, "encode", "png.Encode")
+		if opts.maxBytes == 0 || buf.Len() <= opts.maxBytes {
+			result.png = buf.Bytes()
+			result.outputWidth = rgba.Bounds().Dx()
+			result.outputHeight = rgba.Bounds().Dy()
+			result.stats = stats
+			result.timings = timings
+			addContextLogAttrs(ctx, slog.Float64("duplicate_ratio", stats.DuplicateRatio))
+			return result, nil
+		}
+		if attempt == maxShrinkAttempts {
+			return nil, newAPIError(http.StatusUnprocessableEntity, codeUnprocessable,
+				fmt.Sprintf("result still %d bytes after %d attempts to fit in %d bytes",
+					buf.Len(), attempt+1, opts.maxBytes), nil)
+		}
+
+		width, height := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+		w, h, err := shrinkToFit(width, height, buf.Len(), opts.maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		progress(stageResizing)
+		start = time.Now()
+		rgba = resize(rgba, w, h, opts.filter)
+		timings.observe(start, "resize", "downscale")
+	}
+}
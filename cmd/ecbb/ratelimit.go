@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRateLimitClients caps how many clients the rate limiter remembers.
+	// Past this, clients are forgotten at random, which only ever lets them
+	// make a few more requests than they should.
+	maxRateLimitClients = 100000
+	// rateLimitSweepInterval is how often clients with a full bucket are
+	// forgotten
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateLimit lets a client make `burst` requests at once, refilled at
+// `perMinute` requests a minute
+type rateLimit struct {
+	perMinute int
+	burst     int
+}
+
+// rate returns the refill rate in requests per second
+func (l rateLimit) rate() float64 {
+	return float64(l.perMinute) / 60
+}
+
+// policy returns the limit formatted for the `RateLimit-Policy` header
+func (l rateLimit) policy() string {
+	return fmt.Sprintf("%d;w=%d", l.burst, int(math.Ceil(float64(l.burst)/l.rate())))
+}
+
+// bucket is one client's token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  rateLimit
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client. Clients can have
+// different limits, e.g. for different API keys.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// newRateLimiter creates a rateLimiter and starts sweeping idle clients
+func newRateLimiter() *rateLimiter {
+	rl := &rateLimiter{
+		buckets: make(map[string]*bucket),
+	}
+	go func() {
+		for range time.Tick(rateLimitSweepInterval) {
+			rl.mu.Lock()
+			rl.sweep(time.Now())
+			rl.mu.Unlock()
+		}
+	}()
+	return rl
+}
+
+// refill returns how many tokens a bucket has at `now`
+func (b *bucket) refill(now time.Time) float64 {
+	return math.Min(float64(b.limit.burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.rate())
+}
+
+// sweep forgets clients whose buckets have refilled, since a new bucket would
+// be the same. If there are still too many clients some are forgotten at
+// random. The caller must hold the mutex.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for client, b := range rl.buckets {
+		if b.refill(now) >= float64(b.limit.burst) {
+			delete(rl.buckets, client)
+		}
+	}
+	for client := range rl.buckets {
+		if len(rl.buckets) < maxRateLimitClients {
+			break
+		}
+		delete(rl.buckets, client)
+	}
+}
+
+// rateLimitResult is the outcome of rateLimiter.allow
+type rateLimitResult struct {
+	allowed   bool
+	remaining int
+	// reset is how long until the bucket is full again
+	reset time.Duration
+	// retryAfter is how long until the next request would be allowed
+	retryAfter time.Duration
+}
+
+// allow takes a token from a client's bucket if there's one left. If the
+// client's limit has changed its bucket is adjusted to the new limit.
+func (rl *rateLimiter) allow(client string, limit rateLimit) rateLimitResult {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		if len(rl.buckets) >= maxRateLimitClients {
+			rl.sweep(now)
+		}
+		b = &bucket{tokens: float64(limit.burst), last: now, limit: limit}
+		rl.buckets[client] = b
+	}
+	b.tokens, b.last = b.refill(now), now
+	if b.limit != limit {
+		b.limit = limit
+		b.tokens = math.Min(b.tokens, float64(limit.burst))
+	}
+
+	var res rateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+	res.remaining = int(b.tokens)
+	res.reset = seconds((float64(limit.burst) - b.tokens) / limit.rate())
+	return res
+}
+
+// seconds converts a number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// parseTrustedProxies parses a list of IP addresses and CIDR prefixes
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range proxies {
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR prefix", p)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR prefix", p)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trusted returns true if addr belongs to one of the trusted proxies
+func (s *server) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// unixClientIP is the client IP of requests made over a unix socket without
+// an `X-Forwarded-For` header
+const unixClientIP = "unix"
+
+// clientIP returns the IP address of the client that made a request. If the
+// request came from a trusted proxy the `X-Forwarded-For` header is followed
+// back (right to left) to the first address that isn't a trusted proxy.
+// Anything further left could have been made up by the client.
+//
+// Requests over a unix socket have no address. Only local processes allowed
+// to open the socket (usually a reverse proxy) can make them, so they're
+// treated as coming from a trusted proxy too. Without an `X-Forwarded-For`
+// header they're all from unixClientIP.
+func (s *server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	unixSocket := err != nil
+	if !unixSocket && !s.trusted(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	if !client.IsValid() {
+		return unixClientIP
+	}
+	return client.Unmap().String()
+}
+
+// requestRateLimit returns the client a request is rate limited as and its
+// limit. Requests made with an API key are limited per key, using the key's
+// own limit if it has one. Everything else is limited per client IP.
+func (s *server) requestRateLimit(r *http.Request) (string, rateLimit) {
+	limit := rateLimit{perMinute: s.config().RateLimit, burst: s.config().RateBurst}
+	key := requestAPIKey(r)
+	if key == nil {
+		return "ip " + s.clientIP(r), limit
+	}
+	if key.RateLimit > 0 {
+		limit.perMinute = key.RateLimit
+	}
+	if key.RateBurst > 0 {
+		limit.burst = key.RateBurst
+	}
+	return "key " + key.Name, limit
+}
+
+// limitRate is middleware that rate limits requests by client IP or API key.
+// Every response gets `RateLimit-*` headers describing the client's bucket,
+// and requests over the limit get a 429 with a `Retry-After` header.
+func (s *server) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addLogAttrs(r, slog.String("client_ip", s.clientIP(r)))
+		client, limit := s.requestRateLimit(r)
+		if limit.perMinute == 0 || limit.burst == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		res := s.rateLimiter.allow(client, limit)
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", limit.policy())
+		h.Set("RateLimit-Limit", strconv.Itoa(limit.burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.reset.Seconds()))))
+		if !res.allowed {
+			err := newAPIError(http.StatusTooManyRequests, codeRateLimited,
+				"too many requests, slow down", nil)
+			err.retryAfter = res.retryAfter
+			s.writeError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
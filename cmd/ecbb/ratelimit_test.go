@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter creates a rateLimiter without the sweeping goroutine
+func newTestRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	rl := newTestRateLimiter()
+	limit := rateLimit{perMinute: 60, burst: 3}
+	for i := 0; i < limit.burst; i++ {
+		res := rl.allow("a", limit)
+		if !res.allowed {
+			t.Fatalf("request %d was refused, the burst is %d", i+1, limit.burst)
+		}
+		if want := limit.burst - i - 1; res.remaining != want {
+			t.Errorf("request %d left %d remaining, want %d", i+1, res.remaining, want)
+		}
+	}
+	res := rl.allow("a", limit)
+	if res.allowed {
+		t.Fatal("a request over the burst was allowed")
+	}
+	// One token a second
+	if res.retryAfter <= 0 || res.retryAfter > time.Second {
+		t.Errorf("retryAfter = %s, want at most 1s", res.retryAfter)
+	}
+
+	if !rl.allow("b", limit).allowed {
+		t.Error("another client was refused")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	rl := newTestRateLimiter()
+	limit := rateLimit{perMinute: 60, burst: 5}
+	for i := 0; i < limit.burst; i++ {
+		rl.allow("a", limit)
+	}
+	if rl.allow("a", limit).allowed {
+		t.Fatal("a request over the burst was allowed")
+	}
+
+	// Two seconds is two tokens at one a second
+	rl.buckets["a"].last = time.Now().Add(-2 * time.Second)
+	if res := rl.allow("a", limit); !res.allowed || res.remaining != 1 {
+		t.Errorf("after 2s got allowed %t with %d remaining, want allowed with 1",
+			res.allowed, res.remaining)
+	}
+
+	// A long wait only fills the bucket up to the burst
+	rl.buckets["a"].last = time.Now().Add(-time.Hour)
+	if res := rl.allow("a", limit); res.remaining != limit.burst-1 {
+		t.Errorf("after an hour %d remaining, want %d", res.remaining, limit.burst-1)
+	}
+}
+
+func TestRateLimiterLimitChange(t *testing.T) {
+	rl := newTestRateLimiter()
+	rl.allow("a", rateLimit{perMinute: 60, burst: 10})
+	res := rl.allow("a", rateLimit{perMinute: 60, burst: 2})
+	if !res.allowed || res.remaining != 1 {
+		t.Errorf("after shrinking the burst got allowed %t with %d remaining, want allowed with 1",
+			res.allowed, res.remaining)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newTestRateLimiter()
+	limit := rateLimit{perMinute: 60, burst: 2}
+	rl.allow("idle", limit)
+	rl.allow("busy", limit)
+	rl.allow("busy", limit)
+
+	// idle is full again after a second, busy needs two
+	rl.sweep(time.Now().Add(1500 * time.Millisecond))
+	if _, ok := rl.buckets["idle"]; ok {
+		t.Error("a full bucket wasn't swept")
+	}
+	if _, ok := rl.buckets["busy"]; !ok {
+		t.Error("a bucket that isn't full was swept")
+	}
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	if got, want := (rateLimit{perMinute: 60, burst: 10}).policy(), "10;w=10"; got != want {
+		t.Errorf("policy() = %q, want %q", got, want)
+	}
+	if got, want := (rateLimit{perMinute: 120, burst: 20}).policy(), "20;w=10"; got != want {
+		t.Errorf("policy() = %q, want %q", got, want)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{trustedProxies: proxies}
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"8.8.8.8:1234", "", "8.8.8.8"},
+		// Untrusted clients can't pick their IP
+		{"8.8.8.8:1234", "1.2.3.4", "8.8.8.8"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "1.2.3.4", "1.2.3.4"},
+		// Everything left of the first untrusted hop could be made up
+		{"10.1.2.3:1234", "6.6.6.6, 1.2.3.4, 192.168.1.1", "1.2.3.4"},
+		{"10.1.2.3:1234", "garbage, 1.2.3.4", "1.2.3.4"},
+		{"[::ffff:10.1.2.3]:1234", "1.2.3.4", "1.2.3.4"},
+		// Unix sockets are trusted like a proxy
+		{"@", "1.2.3.4", "1.2.3.4"},
+		{"", "1.2.3.4", "1.2.3.4"},
+		{"@", "", unixClientIP},
+		{"@", "garbage", unixClientIP},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%q, X-Forwarded-For %q) = %q, want %q", tt.remoteAddr, tt.xff, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Each time an encoded result is still over the `maxBytes` budget we shrink
+	// the image by at least this much before trying again.
+	maxShrinkFactor = 0.9
+	// Give up on squeezing an image under `maxBytes` after this many attempts.
+	// Noisy ECB output compresses terribly so we may need a few tries.
+	maxShrinkAttempts = 16
+)
+
+// resampleFilter describes a separable resampling kernel. The kernel is
+// evaluated for distances in the range [-support, support] (in source pixels
+// at a 1:1 scale).
+type resampleFilter struct {
+	name    string
+	support float64
+	kernel  func(float64) float64
+}
+
+var (
+	boxFilter = resampleFilter{
+		name:    "box",
+		support: 0.5,
+		kernel: func(x float64) float64 {
+			if x >= -0.5 && x < 0.5 {
+				return 1
+			}
+			return 0
+		},
+	}
+	bilinearFilter = resampleFilter{
+		name:    "bilinear",
+		support: 1,
+		kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1 {
+				return 1 - x
+			}
+			return 0
+		},
+	}
+	catmullRomFilter = resampleFilter{
+		name:    "catmullrom",
+		support: 2,
+		kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			switch {
+			case x < 1:
+				return (1.5*x-2.5)*x*x + 1
+			case x < 2:
+				return ((-0.5*x+2.5)*x-4)*x + 2
+			}
+			return 0
+		},
+	}
+
+	// resampleFilters maps the names accepted by the API to filters
+	resampleFilters = map[string]resampleFilter{
+		boxFilter.name:        boxFilter,
+		bilinearFilter.name:   bilinearFilter,
+		catmullRomFilter.name: catmullRomFilter,
+	}
+)
+
+// resizeOptions holds the downscaling limits requested for an image. A zero
+// value for any of the limits means "no limit".
+type resizeOptions struct {
+	maxWidth  int
+	maxHeight int
+	maxBytes  int
+	filter    resampleFilter
+}
+
+// parseResizeOptions reads the optional `maxWidth`, `maxHeight`, `maxBytes`
+// and `resample` form values from a request
+func parseResizeOptions(r *http.Request) (resizeOptions, error) {
+	var maxWidth, maxHeight, maxBytes int
+	limits := []struct {
+		field string
+		value *int
+	}{
+		{"maxWidth", &maxWidth},
+		{"maxHeight", &maxHeight},
+		{"maxBytes", &maxBytes},
+	}
+	for _, l := range limits {
+		raw := r.FormValue(l.field)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return resizeOptions{}, fmt.Errorf("%q must be a non-negative integer", l.field)
+		}
+		*l.value = v
+	}
+	return newResizeOptions(maxWidth, maxHeight, maxBytes, r.FormValue("resample"))
+}
+
+// newResizeOptions checks the given limits and looks up the named resampling
+// filter. An empty filter name is Catmull-Rom.
+func newResizeOptions(maxWidth, maxHeight, maxBytes int, resample string) (resizeOptions, error) {
+	opts := resizeOptions{
+		maxWidth:  maxWidth,
+		maxHeight: maxHeight,
+		maxBytes:  maxBytes,
+		filter:    catmullRomFilter,
+	}
+	limits := []struct {
+		field string
+		value int
+	}{
+		{"maxWidth", maxWidth},
+		{"maxHeight", maxHeight},
+		{"maxBytes", maxBytes},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			return opts, fmt.Errorf("%q must be a non-negative integer", l.field)
+		}
+	}
+	if resample != "" {
+		filter, ok := resampleFilters[resample]
+		if !ok {
+			return opts, fmt.Errorf("unknown \"resample\" filter %q", resample)
+		}
+		opts.filter = filter
+	}
+	return opts, nil
+}
+
+// fitDimensions returns the largest width and height that fit inside of maxW
+// by maxH while preserving the aspect ratio of a width by height image. A zero
+// maxW or maxH leaves that dimension unconstrained. Images are never enlarged.
+func fitDimensions(width, height, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && width > maxW {
+		scale = math.Min(scale, float64(maxW)/float64(width))
+	}
+	if maxH > 0 && height > maxH {
+		scale = math.Min(scale, float64(maxH)/float64(height))
+	}
+	if scale == 1.0 {
+		return width, height
+	}
+	return scaleDimensions(width, height, scale)
+}
+
+// scaleDimensions multiplies width and height by scale, never returning
+// a dimension smaller than one pixel
+func scaleDimensions(width, height int, scale float64) (int, int) {
+	w := int(math.Round(float64(width) * scale))
+	h := int(math.Round(float64(height) * scale))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// contribution is the weighted set of source pixels that make up one
+// destination pixel along a single axis
+type contribution struct {
+	start   int
+	weights []float64
+}
+
+// contributions precomputes the filter weights used to resample srcLen pixels
+// into dstLen pixels along one axis
+func contributions(srcLen, dstLen int, filter resampleFilter) []contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	// When shrinking, widen the filter so that every source pixel contributes
+	// to the output. Otherwise we'd just be point sampling with extra steps.
+	filterScale := math.Max(scale, 1)
+	support := filter.support * filterScale
+
+	contribs := make([]contribution, dstLen)
+	for i := range contribs {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		if start < 0 {
+			start = 0
+		}
+		if end > srcLen-1 {
+			end = srcLen - 1
+		}
+
+		weights := make([]float64, 0, end-start+1)
+		sum := 0.0
+		for j := start; j <= end; j++ {
+			w := filter.kernel((float64(j) - center) / filterScale)
+			weights = append(weights, w)
+			sum += w
+		}
+		// Normalize so the weights always add up to one. If the kernel didn't
+		// land on any pixel (e.g. a box filter at an awkward scale) fall back to
+		// the nearest source pixel.
+		if sum == 0 {
+			nearest := int(math.Round(center))
+			if nearest < start {
+				nearest = start
+			}
+			if nearest > end {
+				nearest = end
+			}
+			weights = weights[:0]
+			for j := start; j <= end; j++ {
+				if j == nearest {
+					weights = append(weights, 1)
+				} else {
+					weights = append(weights, 0)
+				}
+			}
+			sum = 1
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		contribs[i] = contribution{start: start, weights: weights}
+	}
+	return contribs
+}
+
+// clampByte rounds a filtered channel value and clamps it to [0, max]
+func clampByte(v float64, max uint8) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > float64(max) {
+		return max
+	}
+	return uint8(v)
+}
+
+// resize resamples an RGBA image to width by height pixels using the given
+// filter. The image is filtered horizontally and then vertically. Since
+// `image.RGBA` stores alpha-premultiplied colour we can filter every channel
+// the same way without getting dark fringes around transparent areas.
+func resize(src *image.RGBA, width, height int, filter resampleFilter) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	// Horizontal pass: srcW x srcH -> width x srcH, kept as floats so that we
+	// only round once at the very end
+	tmp := make([]float64, width*srcH*4)
+	for x, c := range contributions(srcW, width, filter) {
+		for y := 0; y < srcH; y++ {
+			row := src.Pix[y*src.Stride:]
+			var r, g, b, a float64
+			for i, w := range c.weights {
+				off := (c.start + i) * 4
+				r += float64(row[off+0]) * w
+				g += float64(row[off+1]) * w
+				b += float64(row[off+2]) * w
+				a += float64(row[off+3]) * w
+			}
+			off := (y*width + x) * 4
+			tmp[off+0], tmp[off+1], tmp[off+2], tmp[off+3] = r, g, b, a
+		}
+	}
+
+	// Vertical pass: width x srcH -> width x height
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, c := range contributions(srcH, height, filter) {
+		for x := 0; x < width; x++ {
+			var r, g, b, a float64
+			for i, w := range c.weights {
+				off := ((c.start+i)*width + x) * 4
+				r += tmp[off+0] * w
+				g += tmp[off+1] * w
+				b += tmp[off+2] * w
+				a += tmp[off+3] * w
+			}
+			// Premultiplied colour channels must never exceed alpha. Catmull-Rom
+			// likes to overshoot around sharp edges so clamp them explicitly.
+			alpha := clampByte(a, 0xff)
+			off := y*dst.Stride + x*4
+			dst.Pix[off+0] = clampByte(r, alpha)
+			dst.Pix[off+1] = clampByte(g, alpha)
+			dst.Pix[off+2] = clampByte(b, alpha)
+			dst.Pix[off+3] = alpha
+		}
+	}
+	return dst
+}
+
+// downscale shrinks an RGBA image to fit inside of the maximum width and height
+// from opts. Images that already fit are returned unchanged.
+func downscale(rgba *image.RGBA, opts resizeOptions) *image.RGBA {
+	width, height := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	w, h := fitDimensions(width, height, opts.maxWidth, opts.maxHeight)
+	if w == width && h == height {
+		return rgba
+	}
+	return resize(rgba, w, h, opts.filter)
+}
+
+// shrinkToFit computes the dimensions to try next when an encoded image of
+// size bytes is over the maxBytes budget. PNG size is roughly proportional to
+// pixel count so scale both dimensions by the square root of the overshoot,
+// always shrinking by at least `maxShrinkFactor`. It returns a 422 apiError if
+// the image can't get any smaller.
+func shrinkToFit(width, height, size, maxBytes int) (int, int, error) {
+	scale := math.Min(math.Sqrt(float64(maxBytes)/float64(size)), maxShrinkFactor)
+	w, h := scaleDimensions(width, height, scale)
+	if w == width && h == height {
+		return 0, 0, newAPIError(http.StatusUnprocessableEntity, codeUnprocessable,
+			fmt.Sprintf("can't shrink a %dx%d image any further to fit in %d bytes",
+				width, height, maxBytes), nil)
+	}
+	return w, h, nil
+}
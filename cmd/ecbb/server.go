@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// server holds everything the ecbb HTTP handlers need to be happy
+type server struct {
+	// cfg is the current config. Most settings are fixed at startup but some
+	// can be changed through the admin API, which swaps in a new config.
+	cfg atomic.Pointer[config]
+	log *slog.Logger
+	// fingerprintSalt is the HMAC key used by `logKey` and for cache keys
+	fingerprintSalt []byte
+	// admission limits how many CPU heavy requests run at once
+	admission *admission
+	// rateLimiter limits requests per client IP or API key
+	rateLimiter *rateLimiter
+	// apiKeys are the keys from `APIKeysFile`, nil if it isn't set
+	apiKeys *apiKeys
+	// trustedProxies are the parsed `TrustedProxies`
+	trustedProxies []netip.Prefix
+	// jobs runs the asynchronous jobs submitted to `/v1/jobs`
+	jobs *jobRunner
+	// fetcher downloads images from URLs given to `/new`
+	fetcher *fetcher
+	// cache holds recent encryption results
+	cache *resultCache
+	// store holds results saved for `/r/{id}`, nil if storing is turned off
+	store resultStore
+	// draining is set once the server starts shutting down
+	draining atomic.Bool
+	// started is when the server was created
+	started time.Time
+	// adminMu serializes config changes made through the admin API
+	adminMu sync.Mutex
+	// audit records config changes made through the admin API
+	audit *auditLog
+}
+
+// newServer creates a server with the given config that logs to STDOUT
+func newServer(cfg config) (*server, error) {
+	s := &server{
+		log:             newLogger(cfg, os.Stdout),
+		fingerprintSalt: []byte(cfg.KeyFingerprintSalt),
+		started:         time.Now(),
+	}
+	s.cfg.Store(&cfg)
+	s.audit = newAuditLog(cfg.AuditLogFile, s.log)
+	// The salt is needed for cache keys even if fingerprints aren't logged
+	if len(s.fingerprintSalt) == 0 {
+		s.fingerprintSalt = make([]byte, 32)
+		rand.Read(s.fingerprintSalt)
+		if cfg.LogKeyFingerprints || cfg.CacheDir != "" {
+			s.log.Info("using a random key fingerprint salt, fingerprints and cacheDir entries won't match across restarts")
+		}
+	}
+	// The proxies were already checked by config.validate()
+	s.trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies)
+	s.rateLimiter = newRateLimiter()
+	if cfg.APIKeysFile != "" {
+		keys, err := newAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		s.apiKeys = keys
+	}
+	cache, err := newResultCache(cfg.CacheBytes, cfg.CacheDir, s.fingerprintSalt, s.log)
+	if err != nil {
+		return nil, fmt.Errorf("loading result cache: %s", err)
+	}
+	s.cache = cache
+	s.store, err = newResultStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("opening result store: %s", err)
+	}
+	if s.store != nil {
+		go s.expireStoredResults()
+	}
+	s.fetcher = newFetcher(cfg)
+	s.admission = newAdmission(cfg.MaxConcurrent, cfg.MaxQueued, cfg.QueueTimeout)
+	s.jobs = newJobRunner(cfg, s.log, s.admission, s.cache)
+	return s, nil
+}
+
+// config returns the server's current config. It must not be modified, see
+// updateConfig.
+func (s *server) config() *config {
+	return s.cfg.Load()
+}
+
+// routes returns a mux with all of the server's handlers registered
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/new", s.requireFeature(featureEncrypt, s.newECB))
+	mux.HandleFunc("/visualize", s.requireFeature(featureVisualize, s.visualizeECB))
+	mux.HandleFunc("/wav", s.requireFeature(featureWAV, s.wavECB))
+	mux.HandleFunc("/contactsheet", s.requireFeature(featureContactSheet, s.contactSheetECB))
+	mux.HandleFunc("/v1/encrypt", s.requireFeature(featureEncrypt, s.encryptV1))
+	mux.HandleFunc("/v1/openapi.json", s.openAPI)
+	mux.HandleFunc("/v1/status", s.status)
+	mux.HandleFunc("/v1/batch", s.requireFeature(featureBatch, s.batch))
+	mux.HandleFunc("/v1/jobs", s.requireFeature(featureJobs, s.submitJob))
+	mux.HandleFunc("/v1/jobs/{id}", s.requireFeature(featureJobs, s.jobStatus))
+	mux.HandleFunc("/v1/jobs/{id}/result", s.requireFeature(featureJobs, s.jobResult))
+	mux.HandleFunc("/r/{id}", s.storedResultHandler)
+	mux.HandleFunc("/admin/config", s.requireFeature(featureAdmin, s.adminConfig))
+	mux.HandleFunc("/admin/stats", s.requireFeature(featureAdmin, s.adminStats))
+	mux.HandleFunc("/admin/audit", s.requireFeature(featureAdmin, s.adminAudit))
+	return mux
+}
+
+// handler returns the server's HTTP handler. The health and metrics endpoints
+// sit outside authentication and rate limiting so that load balancers and
+// Prometheus can always reach them, as does the upload page since it's only
+// static files.
+func (s *server) handler() http.Handler {
+	api := s.routes()
+	root := http.NewServeMux()
+	root.Handle("/", recordRoute(api, s.authenticate(s.limitRate(api))))
+	root.HandleFunc("/{$}", s.uiIndex)
+	root.HandleFunc("/ui/{name}", s.uiAsset)
+	root.HandleFunc("/healthz", s.healthz)
+	root.HandleFunc("/readyz", s.readyz)
+	root.HandleFunc("/metrics", s.metrics)
+	return s.logRequests(recordRoute(root, root))
+}
+
+// httpServer returns an http.Server for the server's routes using the
+// configured bind address, timeouts and limits
+func (s *server) httpServer() *http.Server {
+	return &http.Server{
+		Addr:              s.config().Listen,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: s.config().ReadHeaderTimeout,
+		ReadTimeout:       s.config().ReadTimeout,
+		WriteTimeout:      s.config().WriteTimeout,
+		IdleTimeout:       s.config().IdleTimeout,
+		MaxHeaderBytes:    s.config().MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(s.log.Handler(), slog.LevelWarn),
+	}
+}
+
+// parseForm limits the request body to the configured `MaxBodyBytes` and
+// parses it as a multi-part form. If the form can't be parsed an error
+// response is written and false is returned.
+func (s *server) parseForm(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config().MaxBodyBytes)
+	err := r.ParseMultipartForm(s.config().MaxBodyBytes)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.writeError(w, r, newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("request body larger than %d bytes", s.config().MaxBodyBytes), err))
+		return false
+	}
+	s.writeError(w, r, newAPIError(http.StatusBadRequest, codeBadRequest,
+		"bad multipart/form-data request body", err))
+	return false
+}
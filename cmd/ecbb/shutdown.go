@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// run calls serve (e.g. srv.ListenAndServe) and blocks until it fails or the
+// process gets a SIGINT or SIGTERM, in which case the server is shut down
+// gracefully. A second signal during shutdown exits straight away.
+func (s *server) run(srv *http.Server, serve func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve()
+	}()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigs:
+		go func() {
+			sig := <-sigs
+			s.log.Warn("got a second signal, exiting without finishing shutdown",
+				"signal", sig.String())
+			os.Exit(1)
+		}()
+		s.shutdown(srv, sig)
+		return nil
+	}
+}
+
+// shutdown gracefully stops the server. `/readyz` starts failing straight
+// away and the server keeps accepting connections for `ShutdownDelay` so
+// load balancers notice. Then the listener is closed and in-flight requests
+// and jobs get `ShutdownGracePeriod` to finish before they're cut off. A
+// summary is logged at the end.
+func (s *server) shutdown(srv *http.Server, sig os.Signal) {
+	start := time.Now()
+	s.draining.Store(true)
+	running, queued := s.admission.depth()
+	s.log.Info("shutting down",
+		"signal", sig.String(),
+		"in_flight", httpInFlight.load(),
+		"encryptions_running", running,
+		"encryptions_queued", queued,
+		"jobs_queued", len(s.jobs.queue),
+		"delay", s.config().ShutdownDelay,
+		"grace_period", s.config().ShutdownGracePeriod)
+	time.Sleep(s.config().ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().ShutdownGracePeriod)
+	defer cancel()
+	inFlight := httpInFlight.load()
+	var abandoned int64
+	if err := srv.Shutdown(ctx); err != nil {
+		// Whatever is still running now gets cut off
+		abandoned = httpInFlight.load()
+		srv.Close()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			s.log.Error("shutting down the HTTP server", "error", err)
+		}
+	}
+	canceledJobs := s.jobs.shutdown(ctx)
+
+	level := slog.LevelInfo
+	if abandoned > 0 || canceledJobs > 0 {
+		level = slog.LevelWarn
+	}
+	s.log.LogAttrs(context.Background(), level, "shutdown complete",
+		slog.Duration("duration", time.Since(start)),
+		slog.Int64("requests_drained", inFlight-abandoned),
+		slog.Int64("requests_abandoned", abandoned),
+		slog.Int("jobs_canceled", canceledJobs))
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The result store backends `store` can be set to
+const (
+	storeMemory = "memory"
+	storeDir    = "dir"
+)
+
+var (
+	// errStoredResultNotFound is returned by a resultStore for IDs it doesn't
+	// have
+	errStoredResultNotFound = errors.New("stored result not found")
+	// errStoreFull is returned by a resultStore when a result would take it
+	// over its `storeMaxBytes`
+	errStoreFull = errors.New("result store is full")
+)
+
+// storedResult is a result saved so it can be shared with a link. The PNG
+// isn't part of the JSON since the directory store keeps it in its own file.
+type storedResult struct {
+	ID string `json:"id"`
+	// DeleteTokenHash is the hex SHA256 of the delete token. The token itself
+	// is only ever given to whoever stored the result.
+	DeleteTokenHash string    `json:"deleteTokenHash"`
+	Created         time.Time `json:"created"`
+	Expires         time.Time `json:"expires"`
+	Size            int64     `json:"size"`
+	PNG             []byte    `json:"-"`
+}
+
+// expired returns true if the result has expired by now
+func (res *storedResult) expired(now time.Time) bool {
+	return !now.Before(res.Expires)
+}
+
+// resultStore saves results for `/r/{id}` until they expire or are deleted.
+// Implementations must be safe to use from multiple goroutines.
+type resultStore interface {
+	// put saves a new result, or returns errStoreFull
+	put(res *storedResult) error
+	// get returns the result with the given ID, PNG and all, or
+	// errStoredResultNotFound. Expired results may still be returned, it's up
+	// to the caller to check.
+	get(id string) (*storedResult, error)
+	// delete removes a result. Deleting a missing result isn't an error.
+	delete(id string) error
+	// expire deletes every result that has expired by now and returns how
+	// many there were
+	expire(now time.Time) (int, error)
+	// usage returns the number of results stored and their total size
+	usage() (results int, used int64)
+}
+
+// newResultStore creates the result store configured by `store`, or returns
+// nil if it isn't set
+func newResultStore(cfg config) (resultStore, error) {
+	switch cfg.Store {
+	case storeMemory:
+		return newMemoryStore(cfg.StoreMaxBytes), nil
+	case storeDir:
+		return newDirStore(cfg.StoreDir, cfg.StoreMaxBytes)
+	}
+	return nil, nil
+}
+
+// memoryStore is a resultStore that keeps everything in memory, so results
+// are lost on restart
+type memoryStore struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	used    int64
+	results map[string]*storedResult
+}
+
+// newMemoryStore creates an empty memoryStore that holds up to maxBytes of
+// PNGs
+func newMemoryStore(maxBytes int64) *memoryStore {
+	return &memoryStore{
+		maxBytes: maxBytes,
+		results:  make(map[string]*storedResult),
+	}
+}
+
+// put saves a result unless it would take the store over budget
+func (m *memoryStore) put(res *storedResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used+res.Size > m.maxBytes {
+		return errStoreFull
+	}
+	m.results[res.ID] = res
+	m.used += res.Size
+	return nil
+}
+
+// get returns a result from memory
+func (m *memoryStore) get(id string) (*storedResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res, ok := m.results[id]
+	if !ok {
+		return nil, errStoredResultNotFound
+	}
+	return res, nil
+}
+
+// delete forgets a result
+func (m *memoryStore) delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if res, ok := m.results[id]; ok {
+		delete(m.results, id)
+		m.used -= res.Size
+	}
+	return nil
+}
+
+// expire forgets every result that has expired by now
+func (m *memoryStore) expire(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, res := range m.results {
+		if res.expired(now) {
+			delete(m.results, id)
+			m.used -= res.Size
+			n++
+		}
+	}
+	return n, nil
+}
+
+// usage returns the number of results in memory and the bytes they use
+func (m *memoryStore) usage() (int, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.results), m.used
+}
+
+// dirStore is a resultStore that writes each result to a directory as
+// `<id>.png` and `<id>.json`, so results survive restarts. The JSON files are
+// kept in memory as an index.
+type dirStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	used  int64
+	index map[string]*storedResult
+}
+
+// newDirStore creates dir if need be and indexes the results already in it.
+// Results that can't be read are removed.
+func newDirStore(dir string, maxBytes int64) (*dirStore, error) {
+	d := &dirStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		index:    make(map[string]*storedResult),
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok || !validStoreID(id) {
+			continue
+		}
+		res, err := d.readMeta(id)
+		if err != nil {
+			d.remove(id)
+			continue
+		}
+		d.index[id] = res
+		d.used += res.Size
+	}
+	return d, nil
+}
+
+// path returns the path of one of a result's files
+func (d *dirStore) path(id, ext string) string {
+	return filepath.Join(d.dir, id+ext)
+}
+
+// readMeta reads a result's JSON file
+func (d *dirStore) readMeta(id string) (*storedResult, error) {
+	raw, err := ioutil.ReadFile(d.path(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	var res storedResult
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	if res.ID != id {
+		return nil, fmt.Errorf("%s.json has ID %q", id, res.ID)
+	}
+	return &res, nil
+}
+
+// remove deletes a result's files
+func (d *dirStore) remove(id string) {
+	os.Remove(d.path(id, ".json"))
+	os.Remove(d.path(id, ".png"))
+}
+
+// put saves a result unless it would take the store over budget. The files
+// are written like the result cache's, under a temporary name and renamed
+// into place with the JSON last.
+func (d *dirStore) put(res *storedResult) error {
+	meta, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	// Space is reserved first so the files can be written without the mutex
+	d.mu.Lock()
+	if d.used+res.Size > d.maxBytes {
+		d.mu.Unlock()
+		return errStoreFull
+	}
+	d.used += res.Size
+	d.mu.Unlock()
+
+	for _, f := range []struct {
+		ext  string
+		data []byte
+	}{{".png", res.PNG}, {".json", meta}} {
+		tmp := filepath.Join(d.dir, "."+res.ID+f.ext+".tmp")
+		err := ioutil.WriteFile(tmp, f.data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, d.path(res.ID, f.ext))
+		}
+		if err != nil {
+			os.Remove(tmp)
+			d.remove(res.ID)
+			d.mu.Lock()
+			d.used -= res.Size
+			d.mu.Unlock()
+			return err
+		}
+	}
+
+	indexed := *res
+	indexed.PNG = nil
+	d.mu.Lock()
+	d.index[res.ID] = &indexed
+	d.mu.Unlock()
+	return nil
+}
+
+// get returns a result from the index with its PNG read from disk
+func (d *dirStore) get(id string) (*storedResult, error) {
+	d.mu.Lock()
+	indexed, ok := d.index[id]
+	d.mu.Unlock()
+	if !ok {
+		return nil, errStoredResultNotFound
+	}
+	png, err := ioutil.ReadFile(d.path(id, ".png"))
+	if os.IsNotExist(err) {
+		// Deleted since we looked at the index
+		return nil, errStoredResultNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	res := *indexed
+	res.PNG = png
+	return &res, nil
+}
+
+// delete removes a result from the index and the directory
+func (d *dirStore) delete(id string) error {
+	d.mu.Lock()
+	res, ok := d.index[id]
+	if ok {
+		delete(d.index, id)
+		d.used -= res.Size
+	}
+	d.mu.Unlock()
+	if ok {
+		d.remove(id)
+	}
+	return nil
+}
+
+// expire removes every result that has expired by now
+func (d *dirStore) expire(now time.Time) (int, error) {
+	var expired []string
+	d.mu.Lock()
+	for id, res := range d.index {
+		if res.expired(now) {
+			delete(d.index, id)
+			d.used -= res.Size
+			expired = append(expired, id)
+		}
+	}
+	d.mu.Unlock()
+	for _, id := range expired {
+		d.remove(id)
+	}
+	return len(expired), nil
+}
+
+// usage returns the number of results in the directory and the bytes they
+// use
+func (d *dirStore) usage() (int, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.index), d.used
+}
+
+// storeIDBytes is the number of random bytes in a stored result ID. 9 bytes
+// is 12 characters of URL safe base64, short enough to tweet and too long to
+// guess.
+const storeIDBytes = 9
+
+// newStoreID returns a random stored result ID
+func newStoreID() string {
+	var buf [storeIDBytes]byte
+	rand.Read(buf[:])
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+// validStoreID returns true if id looks like one from newStoreID. IDs are
+// used as file names so anything else is turned away before it gets near
+// a store.
+func validStoreID(id string) bool {
+	if len(id) != base64.RawURLEncoding.EncodedLen(storeIDBytes) {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// hashDeleteToken returns the hex SHA256 of a delete token
+func hashDeleteToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// storedResultView is what's returned to whoever stored a result
+type storedResultView struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// DeleteToken is sent in the `X-ECBB-Delete-Token` header of a DELETE to
+	// remove the result before it expires
+	DeleteToken string    `json:"deleteToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// resultURL returns the URL of a stored result. It's relative unless
+// `publicURL` is set.
+func (s *server) resultURL(id string) string {
+	return strings.TrimSuffix(s.config().PublicURL, "/") + "/r/" + id
+}
+
+// wantsStore returns true if a `/new` request asked for its result to be
+// stored
+func wantsStore(r *http.Request) (bool, error) {
+	raw := r.FormValue("store")
+	if raw == "" {
+		return false, nil
+	}
+	store, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%q must be true or false", "store")
+	}
+	return store, nil
+}
+
+// checkStore returns an apiError if the request can't store results, either
+// because the store isn't configured or its API key doesn't allow it
+func (s *server) checkStore(r *http.Request) error {
+	if s.store == nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidOption,
+			"storing results is turned off on this server", nil)
+	}
+	return s.checkFeature(r, featureStore)
+}
+
+// storeResult saves a PNG for `storeTTL` and returns where to find it
+func (s *server) storeResult(r *http.Request, png []byte) (*storedResultView, error) {
+	// Delete tokens are as hard to guess as job IDs
+	token := newJobID()
+	now := time.Now()
+	res := &storedResult{
+		ID:              newStoreID(),
+		DeleteTokenHash: hashDeleteToken(token),
+		Created:         now,
+		Expires:         now.Add(s.config().StoreTTL),
+		Size:            int64(len(png)),
+		PNG:             png,
+	}
+	if err := s.store.put(res); errors.Is(err, errStoreFull) {
+		return nil, newAPIError(http.StatusServiceUnavailable, codeUnavailable,
+			"the result store is full, try again later", err)
+	} else if err != nil {
+		return nil, internalError(err)
+	}
+	addLogAttrs(r, slog.String("stored_id", res.ID))
+	return &storedResultView{
+		ID:          res.ID,
+		URL:         s.resultURL(res.ID),
+		DeleteToken: token,
+		ExpiresAt:   res.Expires,
+	}, nil
+}
+
+// setStoredHeaders describes a stored result in the headers of a `/new`
+// response, since its body is the PNG
+func setStoredHeaders(w http.ResponseWriter, v *storedResultView) {
+	h := w.Header()
+	h.Set("X-ECBB-Result-ID", v.ID)
+	h.Set("X-ECBB-Result-URL", v.URL)
+	h.Set("X-ECBB-Delete-Token", v.DeleteToken)
+	h.Set("X-ECBB-Result-Expires", v.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// lookupStored returns an unexpired stored result, or a 404 apiError
+func (s *server) lookupStored(id string) (*storedResult, error) {
+	notFound := newAPIError(http.StatusNotFound, codeNotFound,
+		"no result with ID \""+id+"\" (it may have expired or been deleted)", nil)
+	if s.store == nil || !validStoreID(id) {
+		return nil, notFound
+	}
+	res, err := s.store.get(id)
+	if errors.Is(err, errStoredResultNotFound) {
+		return nil, notFound
+	} else if err != nil {
+		return nil, internalError(err)
+	}
+	if res.expired(time.Now()) {
+		return nil, notFound
+	}
+	return res, nil
+}
+
+// storedResultHandler is an HTTP handler that returns a stored result's PNG,
+// or deletes it when the method is DELETE and the right delete token is sent.
+// Anyone with the link can see a result, so it doesn't need an API key.
+func (s *server) storedResultHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireMethod(w, r, http.MethodGet, http.MethodHead, http.MethodDelete) {
+		return
+	}
+
+	id := r.PathValue("id")
+	addLogAttrs(r, slog.String("stored_id", id))
+	res, err := s.lookupStored(id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		token := r.Header.Get("X-ECBB-Delete-Token")
+		if token == "" || subtle.ConstantTimeCompare(
+			[]byte(hashDeleteToken(token)), []byte(res.DeleteTokenHash)) != 1 {
+			s.writeError(w, r, newAPIError(http.StatusForbidden, codeForbidden,
+				"a valid \"X-ECBB-Delete-Token\" header is required to delete a result", nil))
+			return
+		}
+		if err := s.store.delete(id); err != nil {
+			s.writeError(w, r, internalError(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Stored results never change, so they can be cached until they expire
+	maxAge := int(time.Until(res.Expires).Seconds())
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	w.Header().Set("ETag", `"`+id+`"`)
+	http.ServeContent(w, r, "", res.Created, bytes.NewReader(res.PNG))
+}
+
+// expireStoredResults periodically deletes expired results from the store
+func (s *server) expireStoredResults() {
+	interval := s.config().StoreTTL
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		n, err := s.store.expire(time.Now())
+		if err != nil {
+			s.log.Warn("expiring stored results", "error", err)
+		}
+		if n > 0 {
+			s.log.Debug("expired stored results", "results", n)
+		}
+	}
+}
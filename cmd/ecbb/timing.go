@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyDerivationName describes how every endpoint turns a key string into an
+// AES key, see ecbEncryptBytes
+const keyDerivationName = "SHA1-truncated-128"
+
+// diagnosticTrailers are the diagnostic headers `/v1/batch` sends as
+// trailers, since it streams its response before it knows them
+var diagnosticTrailers = []string{
+	"Server-Timing",
+	"X-ECBB-Blocks",
+	"X-ECBB-Duplicate-Blocks",
+	"X-ECBB-Duplicate-Ratio",
+}
+
+// stageTiming is the total time spent in one stage of making a response
+type stageTiming struct {
+	stage string
+	// desc names the function doing the work, for `Server-Timing`
+	desc     string
+	duration time.Duration
+}
+
+// stageTimings are the stage times of one response, in the order the stages
+// first ran. A stage that runs more than once (e.g. when shrinking to fit
+// `maxBytes`) is counted once with its total time.
+type stageTimings []stageTiming
+
+// observe adds the time since start to a stage and records it in the
+// `ecbb_stage_duration_seconds` metric. desc names what did the work.
+func (t *stageTimings) observe(start time.Time, stage, desc string) {
+	d := time.Since(start)
+	stageDuration.observe(d.Seconds(), stage)
+	for i := range *t {
+		if (*t)[i].stage == stage {
+			(*t)[i].duration += d
+			return
+		}
+	}
+	*t = append(*t, stageTiming{stage: stage, desc: desc, duration: d})
+}
+
+// add adds other's stage times to t
+func (t *stageTimings) add(other stageTimings) {
+	for _, o := range other {
+		found := false
+		for i := range *t {
+			if (*t)[i].stage == o.stage {
+				(*t)[i].duration += o.duration
+				found = true
+				break
+			}
+		}
+		if !found {
+			*t = append(*t, o)
+		}
+	}
+}
+
+// diagnostics describe how a response was made, for its `Server-Timing` and
+// `X-ECBB-*` headers. Formats and sizes that are empty aren't reported.
+type diagnostics struct {
+	// cached is true if the result came from the cache, in which case the
+	// stage times belong to the request that made it and aren't reported
+	cached bool
+	// queueWait is how long the request waited for an encryption slot
+	queueWait                 time.Duration
+	timings                   stageTimings
+	inputFormat               string
+	inputWidth, inputHeight   int
+	outputWidth, outputHeight int
+	stats                     blockStats
+}
+
+// diagnostics returns the diagnostics of an encryptResult
+func (res *encryptResult) diagnostics(cached bool, queueWait time.Duration) diagnostics {
+	return diagnostics{
+		cached:       cached,
+		queueWait:    queueWait,
+		timings:      res.timings,
+		inputFormat:  res.inputFormat,
+		inputWidth:   res.inputWidth,
+		inputHeight:  res.inputHeight,
+		outputWidth:  res.outputWidth,
+		outputHeight: res.outputHeight,
+		stats:        res.stats,
+	}
+}
+
+// serverTimingMetric formats one `Server-Timing` metric with its duration in
+// milliseconds
+func serverTimingMetric(name string, d time.Duration, desc string) string {
+	metric := name + ";dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	if desc != "" {
+		metric += `;desc="` + desc + `"`
+	}
+	return metric
+}
+
+// setHeaders sets the `Server-Timing` and `X-ECBB-*` headers describing d
+func (d diagnostics) setHeaders(h http.Header) {
+	if d.cached {
+		h.Set("Server-Timing", `cache;desc="hit"`)
+	} else {
+		metrics := []string{serverTimingMetric("queue", d.queueWait, "")}
+		for _, t := range d.timings {
+			metrics = append(metrics, serverTimingMetric(t.stage, t.duration, t.desc))
+		}
+		h.Set("Server-Timing", strings.Join(metrics, ", "))
+	}
+	h.Set("X-ECBB-Cipher", blockCipherName)
+	h.Set("X-ECBB-KDF", keyDerivationName)
+	if d.inputFormat != "" {
+		h.Set("X-ECBB-Input-Format", d.inputFormat)
+	}
+	if d.inputWidth > 0 {
+		h.Set("X-ECBB-Input-Size", fmt.Sprintf("%dx%d", d.inputWidth, d.inputHeight))
+	}
+	if d.outputWidth > 0 {
+		h.Set("X-ECBB-Output-Size", fmt.Sprintf("%dx%d", d.outputWidth, d.outputHeight))
+	}
+	h.Set("X-ECBB-Blocks", strconv.Itoa(d.stats.Blocks))
+	h.Set("X-ECBB-Duplicate-Blocks", strconv.Itoa(d.stats.DuplicateBlocks))
+	h.Set("X-ECBB-Duplicate-Ratio", strconv.FormatFloat(d.stats.DuplicateRatio, 'f', 4, 64))
+}
+
+// setDiagnosticHeaders describes how a response was made in its
+// `Server-Timing` and `X-ECBB-*` headers
+func setDiagnosticHeaders(w http.ResponseWriter, d diagnostics) {
+	d.setHeaders(w.Header())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// selfSignedValidity is how long a generated self-signed certificate is valid
+// for. It's regenerated every time the server starts.
+const selfSignedValidity = 30 * 24 * time.Hour
+
+// tlsEnabled returns true if the server should speak HTTPS
+func (c config) tlsEnabled() bool {
+	return c.TLSCert != "" || c.TLSSelfSigned
+}
+
+// tlsConfig returns the TLS config for the server. The certificate is loaded
+// from `TLSCert` and `TLSKey`, or generated if `TLSSelfSigned` is set. If
+// `TLSClientCA` is set clients must present a certificate signed by it.
+func (s *server) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if s.config().TLSSelfSigned {
+		cert, err := s.selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("generating a self-signed certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	} else {
+		cert, err := tls.LoadX509KeyPair(s.config().TLSCert, s.config().TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	if s.config().TLSClientCA != "" {
+		pemBytes, err := ioutil.ReadFile(s.config().TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("loading TLS client CA: no certificates found in %q",
+				s.config().TLSClientCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// selfSignedHosts returns the names and addresses a self-signed certificate
+// is made for: localhost plus the host from the listen address, if it has one
+func selfSignedHosts(listen string) (names []string, ips []net.IP) {
+	names = []string{"localhost"}
+	ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil || host == "" || host == "localhost" {
+		return names, ips
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.IsLoopback() && !ip.IsUnspecified() {
+			ips = append(ips, ip)
+		}
+		return names, ips
+	}
+	return append(names, host), ips
+}
+
+// selfSignedCertificate generates a throwaway ECDSA certificate for
+// development. The private key never leaves memory. If `TLSSelfSignedCertFile`
+// is set the certificate is written there so that clients can trust it.
+func (s *server) selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	names, ips := selfSignedHosts(s.config().Listen)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ecbb self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// It's its own CA so that clients can trust it directly
+		IsCA:        true,
+		DNSNames:    names,
+		IPAddresses: ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	s.log.Warn("using a self-signed TLS certificate, don't do this in production",
+		"sha256", hex.EncodeToString(fingerprint[:]),
+		"dns_names", names,
+		"expires", template.NotAfter)
+	if s.config().TLSSelfSignedCertFile != "" {
+		pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err := ioutil.WriteFile(s.config().TLSSelfSignedCertFile, pemBytes, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// validateTLS checks that the TLS settings make sense together
+func (c config) validateTLS() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return settingError{"tlsCert", "", errors.New("tlsCert and tlsKey must be set together")}
+	}
+	if c.TLSSelfSigned && c.TLSCert != "" {
+		return settingError{"tlsSelfSigned", "", errors.New("can't be used with tlsCert and tlsKey")}
+	}
+	if c.TLSSelfSignedCertFile != "" && !c.TLSSelfSigned {
+		return settingError{"tlsSelfSignedCertFile", "", errors.New("needs tlsSelfSigned")}
+	}
+	if c.TLSClientCA != "" && !c.tlsEnabled() {
+		return settingError{"tlsClientCA", "", errors.New("needs tlsCert and tlsKey, or tlsSelfSigned")}
+	}
+	return nil
+}
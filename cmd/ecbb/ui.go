@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// uiFiles is the upload page served at `/`. It's plain HTML, CSS and JS that
+// posts to `/new` and loads nothing from anywhere else, so it works offline.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiContentSecurityPolicy only lets the upload page load its own files and
+// the blob: URLs it makes for previews
+const uiContentSecurityPolicy = "default-src 'self'; img-src 'self' blob:; object-src 'none'; " +
+	"base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// serveUIFile writes one of the embedded UI files
+func (s *server) serveUIFile(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.requireMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	data, err := uiFiles.ReadFile(path.Join("ui", name))
+	if err != nil {
+		s.writeError(w, r, newAPIError(http.StatusNotFound, codeNotFound,
+			"no such file", err))
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	h.Set("Content-Security-Policy", uiContentSecurityPolicy)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// uiIndex is an HTTP handler for the upload page
+func (s *server) uiIndex(w http.ResponseWriter, r *http.Request) {
+	s.serveUIFile(w, r, "index.html")
+}
+
+// uiAsset is an HTTP handler for the upload page's CSS and JS
+func (s *server) uiAsset(w http.ResponseWriter, r *http.Request) {
+	s.serveUIFile(w, r, r.PathValue("name"))
+}
@@ -0,0 +1,104 @@
+// The upload page for ecbb. It posts the picked image to /new and shows the
+// result next to the original. No libraries, so it works offline.
+"use strict";
+
+const form = document.getElementById("form");
+const imageInput = document.getElementById("image");
+const before = document.getElementById("before");
+const after = document.getElementById("after");
+const download = document.getElementById("download");
+const status = document.getElementById("status");
+const submit = document.getElementById("submit");
+
+// Object URLs are revoked when they're replaced so big images don't leak
+let beforeURL = null;
+let afterURL = null;
+
+function setStatus(message, isError) {
+  status.textContent = message;
+  status.classList.toggle("error", Boolean(isError));
+}
+
+function clearResult() {
+  if (afterURL) {
+    URL.revokeObjectURL(afterURL);
+    afterURL = null;
+  }
+  after.removeAttribute("src");
+  download.hidden = true;
+}
+
+// resultName turns "tux.jpg" into "tux.ecb.png", like the example data
+function resultName(name) {
+  const dot = name.lastIndexOf(".");
+  return (dot > 0 ? name.slice(0, dot) : name) + ".ecb.png";
+}
+
+imageInput.addEventListener("change", () => {
+  clearResult();
+  setStatus("");
+  if (beforeURL) {
+    URL.revokeObjectURL(beforeURL);
+    beforeURL = null;
+  }
+  const file = imageInput.files[0];
+  if (file) {
+    beforeURL = URL.createObjectURL(file);
+    before.src = beforeURL;
+  } else {
+    before.removeAttribute("src");
+  }
+});
+
+form.addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const file = imageInput.files[0];
+  if (!file) {
+    setStatus("Pick an image first.", true);
+    return;
+  }
+
+  const body = new FormData();
+  body.append("image", file, file.name);
+  for (const field of ["key", "layout", "maxWidth"]) {
+    const value = document.getElementById(field).value;
+    if (value !== "") {
+      body.append(field, value);
+    }
+  }
+  const headers = {};
+  const token = document.getElementById("token").value.trim();
+  if (token !== "") {
+    headers["Authorization"] = "Bearer " + token;
+  }
+
+  clearResult();
+  submit.disabled = true;
+  setStatus("Encrypting...");
+  try {
+    const resp = await fetch("/new", { method: "POST", body, headers });
+    if (!resp.ok) {
+      // Errors are JSON with a human readable message
+      let message = resp.status + " " + resp.statusText;
+      try {
+        const err = await resp.json();
+        message = err.message + " (" + err.code + ")";
+      } catch (e) {
+        // Not JSON, the status will have to do
+      }
+      setStatus("Couldn't encrypt it: " + message, true);
+      return;
+    }
+    const blob = await resp.blob();
+    afterURL = URL.createObjectURL(blob);
+    after.src = afterURL;
+    download.href = afterURL;
+    download.download = resultName(file.name);
+    download.hidden = false;
+    setStatus("Done. See the penguin?");
+  } catch (e) {
+    setStatus("Couldn't reach the server: " + e.message, true);
+  } finally {
+    submit.disabled = false;
+  }
+});
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultVisualizeWidth is the image width (in pixels) used when the caller
+	// doesn't pick one
+	defaultVisualizeWidth = 256
+	// maxVisualizeWidth keeps the rendered images to a sane size
+	maxVisualizeWidth = 4096
+	// visualizeGap is the number of pixels between the plaintext and ciphertext
+	// renderings
+	visualizeGap = 8
+)
+
+// visualizeOptions controls how arbitrary bytes are turned into pixels
+type visualizeOptions struct {
+	// width is the number of pixels in each row
+	width int
+	// bpp is the number of bytes that make up each pixel:
+	//   1 - 8 bit grayscale
+	//   2 - 16 bit big-endian RGB565
+	//   3 - 24 bit RGB
+	//   4 - 32 bit RGBX (the fourth byte is ignored so the image stays opaque)
+	bpp int
+}
+
+// parseVisualizeOptions reads the optional `width` and `bpp` form values from
+// a request
+func parseVisualizeOptions(r *http.Request) (visualizeOptions, error) {
+	opts := visualizeOptions{
+		width: defaultVisualizeWidth,
+		bpp:   1,
+	}
+	if raw := r.FormValue("width"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxVisualizeWidth {
+			return opts, fmt.Errorf("\"width\" must be an integer between 1 and %d", maxVisualizeWidth)
+		}
+		opts.width = v
+	}
+	if raw := r.FormValue("bpp"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > 4 {
+			return opts, fmt.Errorf("\"bpp\" must be an integer between 1 and 4")
+		}
+		opts.bpp = v
+	}
+	return opts, nil
+}
+
+// height returns the number of rows n bytes take up
+func (opts visualizeOptions) height(n int) int {
+	pixels := (n + opts.bpp - 1) / opts.bpp
+	height := (pixels + opts.width - 1) / opts.width
+	if height < 1 {
+		height = 1
+	}
+	return height
+}
+
+// checkVisualizeSize returns a 413 apiError if the image visualizeBytes
+// renders n bytes as would have more than maxPixels pixels
+func checkVisualizeSize(n int, opts visualizeOptions, maxPixels int64) error {
+	width, height := 2*opts.width+visualizeGap, opts.height(n)
+	if int64(width)*int64(height) > maxPixels {
+		return newAPIError(http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("\"file\" would be rendered as %dx%d, more than %d pixels; try a bigger \"bpp\"",
+				width, height, maxPixels), nil)
+	}
+	return nil
+}
+
+// bytesToImage renders raw bytes as an RGBA image, opts.bpp bytes per pixel
+// and opts.width pixels per row. Any pixels left over in the last row are
+// black.
+func bytesToImage(data []byte, opts visualizeOptions) *image.RGBA {
+	pixels := (len(data) + opts.bpp - 1) / opts.bpp
+	img := image.NewRGBA(image.Rect(0, 0, opts.width, opts.height(len(data))))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	for i := 0; i < pixels; i++ {
+		// Copy the pixel's bytes so a short final pixel is zero filled
+		var px [4]byte
+		copy(px[:], data[i*opts.bpp:])
+
+		var c color.RGBA
+		switch opts.bpp {
+		case 1:
+			c = color.RGBA{px[0], px[0], px[0], 0xff}
+		case 2:
+			v := uint16(px[0])<<8 | uint16(px[1])
+			c = color.RGBA{
+				R: uint8(v>>11) << 3,
+				G: uint8(v>>5&0x3f) << 2,
+				B: uint8(v&0x1f) << 3,
+				A: 0xff,
+			}
+		default:
+			c = color.RGBA{px[0], px[1], px[2], 0xff}
+		}
+		img.SetRGBA(i%opts.width, i/opts.width, c)
+	}
+	return img
+}
+
+// sideBySide returns a new image with left and right drawn next to each other
+// on a white background, separated by `visualizeGap` pixels
+func sideBySide(left, right image.Image) *image.RGBA {
+	lb, rb := left.Bounds(), right.Bounds()
+	height := lb.Dy()
+	if rb.Dy() > height {
+		height = rb.Dy()
+	}
+	out := image.NewRGBA(image.Rect(0, 0, lb.Dx()+visualizeGap+rb.Dx(), height))
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(out, lb.Sub(lb.Min), left, lb.Min, draw.Src)
+	draw.Draw(out, rb.Sub(rb.Min).Add(image.Pt(lb.Dx()+visualizeGap, 0)), right, rb.Min, draw.Src)
+	return out
+}
+
+// visualizeBytes ECB encrypts data with the given key and returns an image of
+// the plaintext bytes next to an image of the ciphertext bytes. The time
+// taken and the ciphertext's block counts are added to d.
+func visualizeBytes(data []byte, key string, opts visualizeOptions, d *diagnostics) (image.Image, error) {
+	start := time.Now()
+	ciphertext, err := ecbEncryptBytes(data, key)
+	if err != nil {
+		return nil, err
+	}
+	d.timings.observe(start, "encrypt", "ecbEncryptBytes")
+	d.stats = countBlocks([][]byte{ciphertext})
+
+	start = time.Now()
+	plainImg := bytesToImage(data, opts)
+	// Only show as many ciphertext bytes as there were plaintext bytes so that
+	// the two renderings line up
+	cipherImg := bytesToImage(ciphertext[:len(data)], opts)
+	img := sideBySide(plainImg, cipherImg)
+	d.timings.observe(start, "render", "bytesToImage")
+	return img, nil
+}
+
+// visualizeECB is an HTTP handler that processes a multi-part form submission
+// with an arbitrary `file` and returns a PNG showing the file's bytes before
+// and after ECB encryption
+func (s *server) visualizeECB(w http.ResponseWriter, r *http.Request) {
+	if !s.requirePOST(w, r) {
+		return
+	}
+
+	if !s.parseForm(w, r) {
+		return
+	}
+
+	key, err := s.requestKey(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+	s.logKey(r, key)
+
+	opts, err := parseVisualizeOptions(r)
+	if err != nil {
+		s.writeError(w, r, classify(err, http.StatusBadRequest, codeInvalidOption))
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		s.writeError(w, r, newAPIError(http.StatusBadRequest, codeMissingField,
+			"missing \"file\" upload", err))
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		s.writeError(w, r, newAPIError(http.StatusBadRequest, codeBadRequest,
+			"\"file\" could not be read", err))
+		return
+	}
+
+	addLogAttrs(r,
+		slog.Int("file_bytes", len(data)),
+		slog.Int("width", opts.width),
+		slog.Int("bpp", opts.bpp))
+
+	if err := checkVisualizeSize(len(data), opts, s.config().MaxPixels); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	start := time.Now()
+	release, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	d := diagnostics{queueWait: time.Since(start)}
+
+	result, err := visualizeBytes(data, key, opts, &d)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.writePNG(w, r, result, d)
+}
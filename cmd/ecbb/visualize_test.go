@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckVisualizeSize(t *testing.T) {
+	opts := visualizeOptions{width: 4096, bpp: 1}
+	// 4096 bytes is one row of (2*4096 + visualizeGap) pixels
+	rowPixels := int64(2*4096 + visualizeGap)
+	if err := checkVisualizeSize(4096, opts, rowPixels); err != nil {
+		t.Errorf("one row within the budget was refused: %s", err)
+	}
+	wantAPIError(t, checkVisualizeSize(4097, opts, rowPixels), http.StatusRequestEntityTooLarge)
+	wantAPIError(t, checkVisualizeSize(32<<20, opts, defaultConfig().MaxPixels), http.StatusRequestEntityTooLarge)
+
+	opts.bpp = 4
+	if err := checkVisualizeSize(4*4096, opts, rowPixels); err != nil {
+		t.Errorf("one row of 4 byte pixels was refused: %s", err)
+	}
+}
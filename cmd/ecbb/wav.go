@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// wavFormatPCM is the `fmt ` chunk audio format for uncompressed PCM data
+	wavFormatPCM = 1
+	// minFmtChunkSize is the size of the PCM `fmt ` chunk fields we care about
+	minFmtChunkSize = 16
+)
+
+// riffChunk is a single chunk from a RIFF file. The chunk ID and body are kept
+// exactly as they were read so that a file can be written back out unchanged
+// apart from the chunks we deliberately modify.
+type riffChunk struct {
+	id   [4]byte
+	body []byte
+}
+
+// wavFormat holds the fields of a WAV `fmt ` chunk that describe PCM data
+type wavFormat struct {
+	audioFormat   uint16
+	channels      uint16
+	sampleRate    uint32
+	byteRate      uint32
+	blockAlign    uint16
+	bitsPerSample uint16
+}
+
+// wavFile is a parsed RIFF/WAVE file. Every chunk is preserved in its original
+// order. `format` is decoded from the `fmt ` chunk and `dataIndex` is the
+// position of the `data` chunk in `chunks`.
+type wavFile struct {
+	format    wavFormat
+	chunks    []riffChunk
+	dataIndex int
+}
+
+// data returns the raw sample bytes from the WAV's `data` chunk
+func (w *wavFile) data() []byte {
+	return w.chunks[w.dataIndex].body
+}
+
+// setData replaces the raw sample bytes of the WAV's `data` chunk
+func (w *wavFile) setData(data []byte) {
+	w.chunks[w.dataIndex].body = data
+}
+
+// unsupportedAudio returns a 415 apiError for audio that isn't an 8 or 16 bit
+// PCM WAV at all
+func unsupportedAudio(format string, args ...interface{}) error {
+	return newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+		"\"audio\" "+fmt.Sprintf(format, args...), nil)
+}
+
+// corruptAudio returns a 422 apiError for a WAV that can't be parsed
+func corruptAudio(format string, args ...interface{}) error {
+	return newAPIError(http.StatusUnprocessableEntity, codeUnprocessable,
+		"\"audio\" "+fmt.Sprintf(format, args...), nil)
+}
+
+// readWAV parses an 8 or 16 bit PCM RIFF/WAVE file from a reader. Audio that
+// isn't an 8 or 16 bit PCM WAV is a 415 apiError, a WAV that can't be parsed
+// is a 422.
+func readWAV(reader io.Reader) (*wavFile, error) {
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 12 || string(raw[0:4]) != "RIFF" || string(raw[8:12]) != "WAVE" {
+		return nil, unsupportedAudio("is not a RIFF/WAVE file")
+	}
+
+	// The RIFF size covers everything after the 8 byte RIFF header. Some
+	// encoders get it wrong so trust the actual length if it's shorter.
+	riffSize := int(binary.LittleEndian.Uint32(raw[4:8]))
+	if end := 8 + riffSize; end >= 12 && end < len(raw) {
+		raw = raw[:end]
+	}
+
+	wav := &wavFile{dataIndex: -1}
+	var haveFmt bool
+	for rest := raw[12:]; len(rest) >= 8; {
+		var c riffChunk
+		copy(c.id[:], rest[0:4])
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		rest = rest[8:]
+		if size > len(rest) {
+			// Truncated files are common enough (e.g. interrupted recordings)
+			// that we accept a short `data` chunk but nothing else.
+			if string(c.id[:]) != "data" {
+				return nil, corruptAudio("has a truncated %q chunk", c.id[:])
+			}
+			size = len(rest)
+		}
+		c.body = rest[:size]
+		rest = rest[size:]
+		// Chunks are padded to an even length
+		if size%2 == 1 && len(rest) > 0 {
+			rest = rest[1:]
+		}
+
+		switch string(c.id[:]) {
+		case "fmt ":
+			if len(c.body) < minFmtChunkSize {
+				return nil, corruptAudio("has a short \"fmt \" chunk (%d bytes)", len(c.body))
+			}
+			wav.format = wavFormat{
+				audioFormat:   binary.LittleEndian.Uint16(c.body[0:2]),
+				channels:      binary.LittleEndian.Uint16(c.body[2:4]),
+				sampleRate:    binary.LittleEndian.Uint32(c.body[4:8]),
+				byteRate:      binary.LittleEndian.Uint32(c.body[8:12]),
+				blockAlign:    binary.LittleEndian.Uint16(c.body[12:14]),
+				bitsPerSample: binary.LittleEndian.Uint16(c.body[14:16]),
+			}
+			haveFmt = true
+		case "data":
+			if wav.dataIndex != -1 {
+				return nil, corruptAudio("has more than one \"data\" chunk")
+			}
+			wav.dataIndex = len(wav.chunks)
+		}
+		wav.chunks = append(wav.chunks, c)
+	}
+
+	if !haveFmt {
+		return nil, corruptAudio("is missing a \"fmt \" chunk")
+	}
+	if wav.dataIndex == -1 {
+		return nil, corruptAudio("is missing a \"data\" chunk")
+	}
+	if wav.format.audioFormat != wavFormatPCM {
+		return nil, unsupportedAudio("uses audio format %d, only PCM is supported",
+			wav.format.audioFormat)
+	}
+	if bits := wav.format.bitsPerSample; bits != 8 && bits != 16 {
+		return nil, unsupportedAudio("has %d bit samples, only 8 and 16 bit are supported", bits)
+	}
+	if wav.format.channels == 0 {
+		return nil, corruptAudio("has zero channels")
+	}
+	return wav, nil
+}
+
+// writeWAV serializes a wavFile back into a RIFF/WAVE file
+func writeWAV(wav *wavFile) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	// Placeholder for the RIFF size, filled in once we know it
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.WriteString("WAVE")
+	for _, c := range wav.chunks {
+		buf.Write(c.id[:])
+		binary.Write(&buf, binary.LittleEndian, uint32(len(c.body)))
+		buf.Write(c.body)
+		if len(c.body)%2 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out
+}
+
+// samples decodes the first channel of a wavFile's sample data into values in
+// the range [-1, 1]
+func (w *wavFile) samples() []float64 {
+	data := w.data()
+	frameSize := int(w.format.channels) * int(w.format.bitsPerSample/8)
+	samples := make([]float64, 0, len(data)/frameSize)
+	for off := 0; off+frameSize <= len(data); off += frameSize {
+		if w.format.bitsPerSample == 8 {
+			// 8 bit PCM is unsigned with silence at 128
+			samples = append(samples, (float64(data[off])-128)/128)
+		} else {
+			v := int16(binary.LittleEndian.Uint16(data[off:]))
+			samples = append(samples, float64(v)/32768)
+		}
+	}
+	return samples
+}
+
+// ecbEncryptWAV returns a copy of wav with its sample data encrypted using AES
+// 128 in ECB mode. Every other chunk (including the header) is left intact.
+// Only whole blocks are encrypted so the sample data keeps its length and
+// the result is still a playable WAV.
+func ecbEncryptWAV(wav *wavFile, key string) (*wavFile, error) {
+	data := wav.data()
+	whole := len(data) - len(data)%16
+	ciphertext, err := ecbEncryptBytes(data[:whole], key)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(data))
+	copy(encrypted, ciphertext[:whole])
+	copy(encrypted[whole:], data[whole:])
+
+	result := &wavFile{
+		format:    wav.format,
+		chunks:    append([]riffChunk(nil), wav.chunks...),
+		dataIndex: wav.dataIndex,
+	}
+	result.setData(encrypted)
+	return result, nil
+}
@@ -2,12 +2,21 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 // ErrorQuit prints msg to stderr and then os.Exit's non-zero
@@ -42,6 +51,13 @@ func GetImage(targetUrl string) ([]byte, error) {
  *  returns the response body bytes or an error
  */
 func PostImage(image []byte, imageField, imageName string, extra map[string]string, targetUrl string, client *http.Client) ([]byte, error) {
+	respBuf, _, err := postImage(image, imageField, imageName, extra, targetUrl, nil, client)
+	return respBuf, err
+}
+
+// postImage is PostImage with extra request headers (e.g. `Authorization`).
+// The response headers are returned along with the body.
+func postImage(image []byte, imageField, imageName string, extra map[string]string, targetUrl string, header http.Header, client *http.Client) ([]byte, http.Header, error) {
 	// Create a buffer for the POST body and a multipart form writer to add
 	// content to it
 	body := &bytes.Buffer{}
@@ -55,42 +71,321 @@ func PostImage(image []byte, imageField, imageName string, extra map[string]stri
 	// Add the image form field and filename
 	formWriter, err := bufWriter.CreateFormFile(imageField, imageName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Copy the input image bytes to the multipart form field
 	inputReader := bytes.NewReader(image)
 	_, err = io.Copy(formWriter, inputReader)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// Save the content type before closing the writer
 	contentType := bufWriter.FormDataContentType()
 	bufWriter.Close()
 
 	// POST to the target URL with the form data as the POST body
-	resp, err := client.Post(targetUrl, contentType, body)
+	req, err := http.NewRequest(http.MethodPost, targetUrl, body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	// Read the response data
 	respBuf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if resp.Status != "200 OK" {
-		return nil, fmt.Errorf("Non-200 response code: %#v", resp.Status)
+		return nil, nil, newAPIError(resp, respBuf)
 	}
-	return respBuf, nil
+	return respBuf, resp.Header, nil
 }
 
-// ECBPostImage is a conveneince wrapper around PostImage that uses the
-// `http.DefaultClient` to send an image to the ECCB HTTP api
-func ECBPostImage(imageBytes []byte, filename, key, server string) ([]byte, error) {
-	endpoint := fmt.Sprintf("%s/new", server)
+// APIError is a non-200 response from an ECBB HTTP api server. Code, Message
+// and RequestID come from the server's JSON error body, if it sent one.
+type APIError struct {
+	Status    string
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("Non-200 response code: %#v", e.Status)
+	}
+	return fmt.Sprintf("Non-200 response code: %#v: %s: %s (request ID %s)",
+		e.Status, e.Code, e.Message, e.RequestID)
+}
+
+// newAPIError returns an APIError for a non-200 response with the given body.
+// A body that isn't a JSON error, e.g. from a proxy, is ignored.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil {
+		apiErr = &APIError{}
+	}
+	apiErr.Status = resp.Status
+	return apiErr
+}
+
+// unixScheme marks a server address as the path of a unix domain socket
+const unixScheme = "unix:"
+
+// ECBClient sends requests to an ECBB HTTP api server
+type ECBClient struct {
+	// Server is the server's address, e.g. "http://localhost:6969", or
+	// "unix:" and the path of the unix domain socket it listens on, e.g.
+	// "unix:/run/ecbb/ecbb.sock". Unix sockets always use plain HTTP.
+	Server string
+	// Token is the API token sent as a bearer token, if the server needs one
+	Token string
+	// HTTPClient is used to make requests. If it's nil `http.DefaultClient` is
+	// used.
+	HTTPClient *http.Client
+	// OnResponse, if it's set, is called with the headers of every successful
+	// response, e.g. to show the server's `Server-Timing` and `X-ECBB-*`
+	// diagnostics
+	OnResponse func(header http.Header)
+
+	// unixOnce makes unixClient, the HTTPClient that dials the Server socket
+	unixOnce   sync.Once
+	unixClient *http.Client
+}
+
+// baseURL returns the URL the server's paths are relative to. For a unix
+// socket the host doesn't matter, it's only sent in the `Host` header.
+func (c *ECBClient) baseURL() string {
+	if strings.HasPrefix(c.Server, unixScheme) {
+		return "http://localhost"
+	}
+	return c.Server
+}
+
+// httpClient returns the http.Client to send requests to the server with
+func (c *ECBClient) httpClient() *http.Client {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	socket, ok := strings.CutPrefix(c.Server, unixScheme)
+	if !ok {
+		return client
+	}
+	c.unixOnce.Do(func() {
+		transport, ok := client.Transport.(*http.Transport)
+		if !ok {
+			transport = http.DefaultTransport.(*http.Transport)
+		}
+		transport = transport.Clone()
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		c.unixClient = &http.Client{
+			Transport:     transport,
+			CheckRedirect: client.CheckRedirect,
+			Jar:           client.Jar,
+			Timeout:       client.Timeout,
+		}
+	})
+	return c.unixClient
+}
+
+// PostImage sends an image to the ECBB HTTP api to be encrypted with the given
+// key. Options (e.g. "maxWidth") are sent as extra form fields. Options with an
+// empty value are left out so the server defaults apply.
+func (c *ECBClient) PostImage(imageBytes []byte, filename, key string, options map[string]string) ([]byte, error) {
+	return c.post("/new", "image", imageBytes, filename, key, options)
+}
+
+// VisualizeFile sends an arbitrary file to the ECBB HTTP api's visualizer.
+// The result is a PNG showing the file's bytes before and after encryption.
+// Options (e.g. "width" and "bpp") are sent as extra form fields.
+func (c *ECBClient) VisualizeFile(fileBytes []byte, filename, key string, options map[string]string) ([]byte, error) {
+	return c.post("/visualize", "file", fileBytes, filename, key, options)
+}
+
+// ContactSheet sends an image to the ECBB HTTP api's contact sheet generator.
+// The result is a PNG grid of the image encrypted once per key. Keys are sent
+// comma separated so they can't contain commas themselves. Options (e.g.
+// "cellSize") are sent as extra form fields.
+func (c *ECBClient) ContactSheet(imageBytes []byte, filename string, keys []string, options map[string]string) ([]byte, error) {
+	fields := map[string]string{
+		"keys": strings.Join(keys, ","),
+	}
+	for k, v := range options {
+		fields[k] = v
+	}
+	return c.post("/contactsheet", "image", imageBytes, filename, "", fields)
+}
+
+// StoredResult describes a result the ECBB HTTP api saved so it can be shared
+// with a link
+type StoredResult struct {
+	ID string
+	// URL is where anyone can download the full resolution result until it
+	// expires
+	URL string
+	// DeleteToken is needed to delete the result before it expires
+	DeleteToken string
+	Expires     time.Time
+}
+
+// PostImageAndStore is like PostImage but also asks the server to save the
+// result, and returns where it was saved. The server must have storing turned
+// on.
+func (c *ECBClient) PostImageAndStore(imageBytes []byte, filename, key string, options map[string]string) ([]byte, *StoredResult, error) {
+	fields := map[string]string{
+		"store": "true",
+	}
+	for k, v := range options {
+		fields[k] = v
+	}
+	respBuf, header, err := c.postWithHeader("/new", "image", imageBytes, filename, key, fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, err := c.storedResult(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return respBuf, stored, nil
+}
+
+// storedResult reads a StoredResult from the `X-ECBB-Result-*` response
+// headers. The server may send a relative URL, so it's resolved against
+// c.Server.
+func (c *ECBClient) storedResult(header http.Header) (*StoredResult, error) {
+	rawURL := header.Get("X-ECBB-Result-URL")
+	if rawURL == "" {
+		return nil, fmt.Errorf("%s didn't say where the result was stored", c.Server)
+	}
+	base, err := url.Parse(c.baseURL())
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad stored result URL %q: %s", rawURL, err)
+	}
+	// A missing or bad expiry time isn't worth failing over
+	expires, _ := http.ParseTime(header.Get("X-ECBB-Result-Expires"))
+	return &StoredResult{
+		ID:          header.Get("X-ECBB-Result-ID"),
+		URL:         base.ResolveReference(ref).String(),
+		DeleteToken: header.Get("X-ECBB-Delete-Token"),
+		Expires:     expires,
+	}, nil
+}
+
+// post uploads a file to an ECBB HTTP api endpoint along with a key and any
+// non-empty options
+func (c *ECBClient) post(path, field string, fileBytes []byte, filename, key string, options map[string]string) ([]byte, error) {
+	respBuf, _, err := c.postWithHeader(path, field, fileBytes, filename, key, options)
+	return respBuf, err
+}
+
+// postWithHeader is post but it also returns the response headers
+func (c *ECBClient) postWithHeader(path, field string, fileBytes []byte, filename, key string, options map[string]string) ([]byte, http.Header, error) {
+	endpoint := fmt.Sprintf("%s%s", c.baseURL(), path)
 	extraFields := map[string]string{
 		"key": key,
 	}
-	return PostImage(imageBytes, "image", filename, extraFields, endpoint, http.DefaultClient)
+	for k, v := range options {
+		if v != "" {
+			extraFields[k] = v
+		}
+	}
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	respBuf, respHeader, err := postImage(fileBytes, field, filename, extraFields, endpoint, header, c.httpClient())
+	if err == nil && c.OnResponse != nil {
+		c.OnResponse(respHeader)
+	}
+	return respBuf, respHeader, err
+}
+
+// NewTLSHTTPClient returns an http.Client for talking to an ECBB HTTP api
+// server over HTTPS. If caFile is set, only servers with a certificate signed
+// by the CA certificates in it (e.g. a self-signed certificate written by
+// `-tlsSelfSignedCertFile`) are trusted instead of the system roots. If
+// certFile and keyFile are set they're presented as a client certificate
+// for servers that require mutual TLS.
+func NewTLSHTTPClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pemBytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no certificates found in %q", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// TokenEnv is the environment variable the ECB* convenience functions read
+// the API token from
+const TokenEnv = "ECBB_TOKEN"
+
+// envClient returns an ECBClient for server that sends the API token from
+// `$ECBB_TOKEN`, if it's set
+func envClient(server string) *ECBClient {
+	return &ECBClient{Server: server, Token: os.Getenv(TokenEnv)}
+}
+
+// ECBPostImage is a conveneince wrapper around PostImage that uses the
+// `http.DefaultClient` to send an image to the ECCB HTTP api. The server is
+// given like `ECBClient.Server`, so it can be a "unix:" socket path. If
+// `$ECBB_TOKEN` is set it's sent as the API token.
+func ECBPostImage(imageBytes []byte, filename, key, server string) ([]byte, error) {
+	return ECBPostImageWithOptions(imageBytes, filename, key, nil, server)
+}
+
+// ECBPostImageWithOptions is like ECBPostImage but also sends the given
+// options (e.g. "maxWidth") as extra form fields. Options with an empty value
+// are left out so the server defaults apply.
+func ECBPostImageWithOptions(imageBytes []byte, filename, key string, options map[string]string, server string) ([]byte, error) {
+	return envClient(server).PostImage(imageBytes, filename, key, options)
+}
+
+// ECBVisualizeFile sends an arbitrary file to the ECBB HTTP api's visualizer.
+// The result is a PNG showing the file's bytes before and after encryption.
+// Options (e.g. "width" and "bpp") are sent as extra form fields.
+func ECBVisualizeFile(fileBytes []byte, filename, key string, options map[string]string, server string) ([]byte, error) {
+	return envClient(server).VisualizeFile(fileBytes, filename, key, options)
+}
+
+// ECBContactSheet sends an image to the ECBB HTTP api's contact sheet
+// generator. The result is a PNG grid of the image encrypted once per key.
+// Keys are sent comma separated so they can't contain commas themselves.
+// Options (e.g. "cellSize") are sent as extra form fields.
+func ECBContactSheet(imageBytes []byte, filename string, keys []string, options map[string]string, server string) ([]byte, error) {
+	return envClient(server).ContactSheet(imageBytes, filename, keys, options)
 }